@@ -2,13 +2,49 @@ package main
 
 import (
 	"flag"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gsheet-exporter/pkg/gsheet"
 	"github.com/gsheet-exporter/pkg/logger"
 	"github.com/gsheet-exporter/pkg/server"
+	"github.com/gsheet-exporter/pkg/skopeo"
+	"github.com/gsheet-exporter/pkg/worker"
 )
 
 var (
 	log = logger.GetInstance()
+
+	dryRun = flag.Bool("dryRun", false, "[bool] print the sync plan (images to copy & delete) and exit")
+
+	// envs that may be left empty
+	optionalEnvs = map[string]bool{
+		"DOCKER_CRED":      true,
+		"QUAY_CRED":        true,
+		"GCR_CRED":         true,
+		"CRED_PROFILES":    true,
+		"AUTH_FILE":        true,
+		"REGISTRY_CRED":    true,
+		"REGISTRY_CA_FILE": true,
+
+		"PROTECTED_REPOS":      true,
+		"DELETE_CONFIRM_TOKEN": true,
+		"RATE_LIMITS":          true,
+		"CHECK_RATE_LIMITS":    true,
+		"SHEET_COLUMNS":        true,
+		"EXPORT_TRUE":          true,
+		"EXPORT_FALSE":         true,
+	}
+
+	// envs of the export and pushv1 steps, not read by a dry run
+	exportEnvs = map[string]bool{
+		"ARCHIVE_PATH":   true,
+		"SCP_DEST":       true,
+		"SCP_PASS":       true,
+		"RELEASE_SHEETS": true,
+	}
 )
 
 func main() {
@@ -16,25 +52,75 @@ func main() {
 	// check environments
 	envs := checkEnvFlags()
 
+	// never log or answer with the configured secrets
+	logger.AddSecret(*envs["SCP_PASS"], *envs["REGISTRY_CRED"], *envs["DOCKER_CRED"], *envs["QUAY_CRED"], *envs["GCR_CRED"],
+		*envs["DELETE_CONFIRM_TOKEN"])
+	profiles := parseProfiles(envs, "CRED_PROFILES")
+	for _, profile := range profiles {
+		logger.AddSecret(profile.Cred)
+	}
+
 	exportServer := server.New(":8080", server.ServerConfig{
 		GoogleConfig: server.GoogleConfig{
 			GoogleCredentials: *envs["GOOGLE_APPLICATION_CREDENTIALS"],
 			TargetSheets:      *envs["TARGET_SHEETS"],
 			SheetsRange:       *envs["SHEETS_RANGE"],
 			ReleaseSheets:     *envs["RELEASE_SHEETS"],
+			SheetColumns:      parseColumns(envs, "SHEET_COLUMNS"),
+			ExportFlag: gsheet.ExportFlag{
+				True:         gsheet.ParseFlagValues(*envs["EXPORT_TRUE"]),
+				False:        gsheet.ParseFlagValues(*envs["EXPORT_FALSE"]),
+				EmptyExclude: parseChoice(envs, "EXPORT_EMPTY", "include", "exclude") == "exclude",
+			},
+			ConflictRule: parseChoice(envs, "CONFLICT_RULE", gsheet.ConflictRules...),
 		},
 		RegistryConfig: server.RegistryConfig{
 			RegistryUrl: *envs["REGISTRY_URL"],
 			ArchivePath: *envs["ARCHIVE_PATH"],
 			ScpDest:     *envs["SCP_DEST"],
 			ScpPass:     *envs["SCP_PASS"],
+
+			RegistryCred:     *envs["REGISTRY_CRED"],
+			RegistryCaFile:   *envs["REGISTRY_CA_FILE"],
+			RegistryInsecure: parseBool(envs, "REGISTRY_INSECURE"),
+			ArchiveFormat:    parseChoice(envs, "ARCHIVE_FORMAT", server.ARCHIVE_STORAGE, server.ARCHIVE_OCI),
 		},
 		CredConfig: server.CredConfig{
 			DockerCred: *envs["DOCKER_CRED"],
 			QuayCred:   *envs["QUAY_CRED"],
 			GcrCred:    *envs["GCR_CRED"],
+			Profiles:   profiles,
+			AuthFile:   parsePath(envs, "AUTH_FILE"),
+		},
+		SyncConfig: server.SyncConfig{
+			MaxDelete:        parseInt(envs, "MAX_DELETE"),
+			MaxDeletePercent: parseFloat(envs, "MAX_DELETE_PERCENT"),
+			ProtectedRepos:   parseList(envs, "PROTECTED_REPOS"),
+			ConfirmToken:     *envs["DELETE_CONFIRM_TOKEN"],
+
+			Concurrency: parseInt(envs, "CONCURRENCY"),
+			RateLimits:  parseRates(envs, "RATE_LIMITS"),
+			CheckLimits: parseRates(envs, "CHECK_RATE_LIMITS"),
+			Retry: skopeo.RetryPolicy{
+				MaxAttempts: parseInt(envs, "RETRY_ATTEMPTS"),
+				Backoff:     parseDuration(envs, "RETRY_BACKOFF"),
+				MaxBackoff:  parseDuration(envs, "RETRY_MAX_BACKOFF"),
+				Jitter:      parseFloat(envs, "RETRY_JITTER"),
+			},
+
+			CheckUpstreamDigest: parseBool(envs, "CHECK_UPSTREAM_DIGEST"),
+			CopyMode:            parseCopyMode(envs, "COPY_MODE"),
+			CopyEngine:          parseChoice(envs, "COPY_ENGINE", server.ENGINE_SKOPEO, server.ENGINE_NATIVE),
+			PushV1Engine:        parseChoice(envs, "PUSHV1_ENGINE", server.ENGINE_DOCKER, server.ENGINE_NATIVE),
 		},
 	})
+	if *dryRun {
+		if err := exportServer.DryRun(os.Stdout); err != nil {
+			log.Error.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	exportServer.Start()
 }
 
@@ -44,20 +130,50 @@ func checkEnvFlags() map[string]*string {
 		"GOOGLE_APPLICATION_CREDENTIALS": flag.String("googleAppCreds", "./credentials.json", "[string] google creds key file path"),
 		"TARGET_SHEETS":                  flag.String("targetSheets", "", "[string] read to target sheets"),
 		"SHEETS_RANGE":                   flag.String("sheetsRange", "CK1!C2:D,CK2!C2:D", "[string] target google sheets cell ranges"),
+		"SHEET_COLUMNS":                  flag.String("sheetColumns", "", "[string] sheet columns by col:letter or header name (ex. image=col:C,export=Export,target=col:F,platform=Arch,comment=Notes,digest=Digest), sync writes status=,timestamp=,mirrored= columns"),
+		"EXPORT_TRUE":                    flag.String("exportTrue", "", "[string] export column values exporting the row, case-insensitive (default: TRUE,yes,y,1,o,v,on,export,예,네)"),
+		"EXPORT_FALSE":                   flag.String("exportFalse", "", "[string] export column values excluding the row, case-insensitive (default: FALSE,no,n,0,x,off,skip,아니오,아니요)"),
+		"EXPORT_EMPTY":                   flag.String("exportEmpty", "include", "[string] empty export cell: include or exclude the row"),
+		"CONFLICT_RULE":                  flag.String("conflictRule", "exclude", "[string] image both exported and excluded by several rows: exclude, include, first, last or error (rejects the rows)"),
 		"RELEASE_SHEETS":                 flag.String("releaseSheets", "", "[string] write on release sheets"),
 		"REGISTRY_URL":                   flag.String("registryUrl", "", "[string] private registry url"),
-		"ARCHIVE_PATH":                   flag.String("archivePath", "", "[string] where you saved tar.gz file"),
+		"REGISTRY_CRED":                  flag.String("registryCred", "", "[string] private registry credentials (user:pass)"),
+		"REGISTRY_CA_FILE":               flag.String("registryCaFile", "", "[string] private registry CA certificate file path"),
+		"REGISTRY_INSECURE":              flag.String("registryInsecure", "false", "[bool] skip private registry tls verify, fall back to http (without credentials)"),
+		"ARCHIVE_PATH":                   flag.String("archivePath", "", "[string] registry storage root, archived by the storage format"),
+		"ARCHIVE_FORMAT":                 flag.String("archiveFormat", "oci", "[string] export archive: oci (OCI image layout of the exported images only, docker load compatible) or storage (tar of archivePath, every tag of the mirror but the excluded images)"),
 		"SCP_DEST":                       flag.String("scpDest", "", "[string] scp destination"),
 		"SCP_PASS":                       flag.String("scpPass", "", "[string] scp passwd"),
 		"DOCKER_CRED":                    flag.String("dockerCred", "", "[string] docker credentials"),
 		"QUAY_CRED":                      flag.String("quayCred", "", "[string] quay cred"),
 		"GCR_CRED":                       flag.String("gcrCred", "", "[string] gcr cred"),
+		"AUTH_FILE":                      flag.String("authFile", "", "[string] docker config.json / containers auth.json path, creds keyed by registry host"),
+		"CRED_PROFILES":                  flag.String("credProfiles", "", "[string] other source registry creds (ex. harbor.corp.io=user:pass,^mirror\\.corp/=user:pass)"),
+		"MAX_DELETE":                     flag.String("maxDelete", "100", "[int] maximum images deleted by a sync without confirmation (0: unlimited)"),
+		"MAX_DELETE_PERCENT":             flag.String("maxDeletePercent", "50", "[float] maximum percentage of registry images deleted without confirmation (0: unlimited)"),
+		"PROTECTED_REPOS":                flag.String("protectedRepos", "", "[string] comma separated repository globs never deleted by sync"),
+		"DELETE_CONFIRM_TOKEN":           flag.String("deleteConfirmToken", "", "[string] '?confirm=' token allowing deletions over the threshold"),
+		"CONCURRENCY":                    flag.String("concurrency", "4", "[int] parallel image copy & delete operations"),
+		"RETRY_ATTEMPTS":                 flag.String("retryAttempts", "3", "[int] attempts of a failed skopeo copy & delete (1: no retry)"),
+		"RETRY_BACKOFF":                  flag.String("retryBackoff", "2s", "[duration] wait before the first retry, doubled every attempt"),
+		"RETRY_MAX_BACKOFF":              flag.String("retryMaxBackoff", "1m", "[duration] maximum wait between retries"),
+		"RETRY_JITTER":                   flag.String("retryJitter", "0.2", "[float] random fraction (0~1) applied to each wait"),
+		"RATE_LIMITS":                    flag.String("rateLimits", "", "[string] per source registry rate limits (ex. docker.io=100/6h,quay.io=30), count per minute without period"),
+		"CHECK_RATE_LIMITS":              flag.String("checkRateLimits", "", "[string] per source registry rate limits of upstream digest checks, apart from the copy rate limits (ex. docker.io=600/1h)"),
+		"CHECK_UPSTREAM_DIGEST":          flag.String("checkUpstreamDigest", "true", "[bool] compare mirrored tags with the source registry digest, re-copy when it changed"),
+		"COPY_ENGINE":                    flag.String("copyEngine", "skopeo", "[string] image copy & delete engine: skopeo (binary) or native (registry v2 api)"),
+		"PUSHV1_ENGINE":                  flag.String("pushv1Engine", "docker", "[string] 'unsupported' sheet push engine: docker (daemon) or native (registry v2 api, schema1 converted to schema2)"),
+		"COPY_MODE":                      flag.String("copyMode", "system", "[string] platforms copied from a multi-arch image: system, all or a single os/arch (ex. linux/arm64)"),
 	}
 	flag.Parse()
 
 	// check requires...
 	for key, env := range envs {
-		if key == "DOCKER_CRED" || key == "QUAY_CRED" || key == "GCR_CRED" {
+		if optionalEnvs[key] || (*dryRun && exportEnvs[key]) {
+			continue
+		}
+		// the oci archive is read from the registry api
+		if key == "ARCHIVE_PATH" && *envs["ARCHIVE_FORMAT"] != server.ARCHIVE_STORAGE {
 			continue
 		}
 
@@ -68,3 +184,105 @@ func checkEnvFlags() map[string]*string {
 	}
 	return envs
 }
+
+func parseBool(envs map[string]*string, key string) bool {
+	value, err := strconv.ParseBool(*envs[key])
+	if err != nil {
+		log.Error.Printf("Invalid '%s' value: %s", key, *envs[key])
+		panic(err)
+	}
+	return value
+}
+
+func parseInt(envs map[string]*string, key string) int {
+	value, err := strconv.Atoi(*envs[key])
+	if err != nil {
+		log.Error.Printf("Invalid '%s' value: %s", key, *envs[key])
+		panic(err)
+	}
+	return value
+}
+
+func parseFloat(envs map[string]*string, key string) float64 {
+	value, err := strconv.ParseFloat(*envs[key], 64)
+	if err != nil {
+		log.Error.Printf("Invalid '%s' value: %s", key, *envs[key])
+		panic(err)
+	}
+	return value
+}
+
+func parseRates(envs map[string]*string, key string) map[string]worker.Rate {
+	rates, err := worker.ParseRates(*envs[key])
+	if err != nil {
+		log.Error.Printf("Invalid '%s' value: %s", key, *envs[key])
+		panic(err)
+	}
+	return rates
+}
+
+func parseProfiles(envs map[string]*string, key string) []skopeo.Profile {
+	profiles, err := skopeo.ParseProfiles(*envs[key])
+	if err != nil {
+		log.Error.Printf("Invalid '%s' value: %v", key, err)
+		panic(err)
+	}
+	return profiles
+}
+
+func parseChoice(envs map[string]*string, key string, choices ...string) string {
+	for _, choice := range choices {
+		if *envs[key] == choice {
+			return choice
+		}
+	}
+	log.Error.Printf("Invalid '%s' value: %s (one of %s)", key, *envs[key], strings.Join(choices, ", "))
+	panic(*envs[key])
+}
+
+func parseColumns(envs map[string]*string, key string) gsheet.Columns {
+	columns, err := gsheet.ParseColumns(*envs[key])
+	if err != nil {
+		log.Error.Printf("Invalid '%s' value: %v", key, err)
+		panic(err)
+	}
+	return columns
+}
+
+func parseCopyMode(envs map[string]*string, key string) string {
+	mode, err := skopeo.ParseCopyMode(*envs[key])
+	if err != nil {
+		log.Error.Printf("Invalid '%s' value: %v", key, err)
+		panic(err)
+	}
+	return mode
+}
+
+func parsePath(envs map[string]*string, key string) string {
+	path, err := skopeo.ExpandPath(*envs[key])
+	if err != nil {
+		log.Error.Printf("Invalid '%s' value: %v", key, err)
+		panic(err)
+	}
+	return path
+}
+
+func parseDuration(envs map[string]*string, key string) time.Duration {
+	value, err := time.ParseDuration(*envs[key])
+	if err != nil {
+		log.Error.Printf("Invalid '%s' value: %s", key, *envs[key])
+		panic(err)
+	}
+	return value
+}
+
+// comma separated list, empty items are dropped
+func parseList(envs map[string]*string, key string) []string {
+	list := []string{}
+	for _, item := range strings.Split(*envs[key], ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -1,49 +1,155 @@
 package command
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"strings"
+	"time"
 
 	"github.com/gsheet-exporter/pkg/logger"
 )
 
-const (
-	DOCKER_PULL = "docker pull %s"      // image
-	DOCKER_TAG  = "docker tag %s %s/%s" // image url/image
-	DOCKER_PUSH = "docker push %s/%s"
-)
+// Program and arguments run without a shell, sheet contents never reach sh
+type Command struct {
+	Name    string
+	Args    []string
+	Env     []string // "KEY=value" added to the process environment (ex. SSHPASS)
+	Stdin   io.Reader
+	Timeout time.Duration // 0: bounded by the context only
+}
+
+// Captured output of a finished command
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int // -1 when the program did not start or was killed
+}
+
+// Runs commands, the Fake replaces it in tests
+type Executor interface {
+	Run(ctx context.Context, cmd Command) (*Result, error)
+}
+
+// Executor starting real processes
+type ExecExecutor struct{}
 
 var (
 	log = logger.GetInstance()
 )
 
-func Run(cmdString string) (string, error) {
-	cmd := exec.Command("sh", "-c", cmdString)
-	output, err := cmd.CombinedOutput()
-	return string(output), err
+func New(name string, args ...string) Command {
+	return Command{Name: name, Args: args}
+}
+
+// Command line for logging (values are not escaped, the logger masks credentials)
+func (cmd Command) String() string {
+	return strings.TrimSpace(cmd.Name + " " + strings.Join(cmd.Args, " "))
 }
 
-func DockerCopy(registryUrl, image string) (string, error) {
-	pull := fmt.Sprintf(DOCKER_PULL, image)
+// Run the command, a non-zero exit code is returned as error with the captured result
+func (ExecExecutor) Run(ctx context.Context, cmd Command) (*Result, error) {
+	return Run(ctx, cmd)
+}
+
+// Run the command as a process (see ExecExecutor)
+func Run(ctx context.Context, cmd Command) (*Result, error) {
+	if cmd.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cmd.Timeout)
+		defer cancel()
+	}
+
+	c := exec.CommandContext(ctx, cmd.Name, cmd.Args...)
+	if len(cmd.Env) > 0 {
+		c.Env = append(os.Environ(), cmd.Env...)
+	}
+	c.Stdin = cmd.Stdin
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+
+	err := c.Run()
+	result := &Result{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: c.ProcessState.ExitCode(),
+	}
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("%s: %v", cmd.Name, ctx.Err())
+	}
+	return result, err
+}
+
+// stdout followed by stderr, for reports and retry classification
+func (result *Result) Output() string {
+	if result == nil {
+		return ""
+	}
+	if result.Stdout == "" || result.Stderr == "" {
+		return result.Stdout + result.Stderr
+	}
+	return result.Stdout + "\n" + result.Stderr
+}
+
+// Run the command and return its output, the error carries the exit code
+func Output(ctx context.Context, executor Executor, cmd Command) (string, error) {
+	result, err := executor.Run(ctx, cmd)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = fmt.Errorf("%s exited with code %d", cmd.Name, result.ExitCode)
+	}
+	return result.Output(), err
+}
+
+// Copy the image through the docker daemon (pull, tag, push) to target ("mirror:5000/nginx:1.25"),
+// the local images are removed afterwards. The target is a tag, docker cannot tag a digest.
+func DockerCopy(executor Executor, image, target string) (string, error) {
+	// an image starting with "-" would be read as a docker option
+	if strings.HasPrefix(image, "-") {
+		return "", fmt.Errorf("invalid image name: %s", image)
+	}
+	if strings.Contains(target, "@") {
+		return "", fmt.Errorf("invalid docker tag: %s", target)
+	}
+	ctx := context.Background()
+
+	pull := New("docker", "pull", image)
 	log.Info.Println(pull)
-	output, err := Run(pull)
+	output, err := Output(ctx, executor, pull)
 	if err != nil {
 		log.Error.Printf("Cannot docker pull : %s", output)
 		return output, err
 	}
-	tag := fmt.Sprintf(DOCKER_TAG, image, registryUrl, image)
+	// pulled images are not kept on the host disk
+	defer dockerRemove(executor, image, target)
+
+	tag := New("docker", "tag", image, target)
 	log.Info.Println(tag)
-	output, err = Run(tag)
+	output, err = Output(ctx, executor, tag)
 	if err != nil {
 		log.Error.Printf("Cannot docker tag : %s", output)
 		return output, err
 	}
-	push := fmt.Sprintf(DOCKER_PUSH, registryUrl, image)
+	push := New("docker", "push", target)
 	log.Info.Println(push)
-	output, err = Run(push)
+	output, err = Output(ctx, executor, push)
 	if err != nil {
 		log.Error.Printf("Cannot docker push : %s", output)
 		return output, err
 	}
 	return output, nil
 }
+
+// Remove local images, a failure is only logged (the push result stands)
+func dockerRemove(executor Executor, images ...string) {
+	rmi := New("docker", append([]string{"rmi"}, images...)...)
+	log.Info.Println(rmi)
+	if output, err := Output(context.Background(), executor, rmi); err != nil {
+		log.Warn.Printf("Cannot docker rmi : %s", output)
+	}
+}
@@ -0,0 +1,66 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Executor recording invocations and answering scripted results, no process is started
+type Fake struct {
+	mu      sync.Mutex
+	Calls   []Command
+	scripts []script
+}
+
+type script struct {
+	prefix string
+	result Result
+	err    error
+}
+
+func NewFake() *Fake {
+	return &Fake{}
+}
+
+// Answer commands whose line starts with prefix ("skopeo copy", "tar").
+// Scripts are matched in registration order, unmatched commands succeed with no output.
+// A non-zero exit code without err fails like a process would.
+func (fake *Fake) On(prefix string, result Result, err error) *Fake {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if err == nil && result.ExitCode != 0 {
+		err = fmt.Errorf("exit status %d", result.ExitCode)
+	}
+	fake.scripts = append(fake.scripts, script{prefix: prefix, result: result, err: err})
+	return fake
+}
+
+func (fake *Fake) Run(ctx context.Context, cmd Command) (*Result, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.Calls = append(fake.Calls, cmd)
+	if err := ctx.Err(); err != nil {
+		return &Result{ExitCode: -1}, err
+	}
+	line := cmd.String()
+	for _, s := range fake.scripts {
+		if strings.HasPrefix(line, s.prefix) {
+			result := s.result
+			return &result, s.err
+		}
+	}
+	return &Result{}, nil
+}
+
+// Command lines run so far
+func (fake *Fake) Lines() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	lines := []string{}
+	for _, cmd := range fake.Calls {
+		lines = append(lines, cmd.String())
+	}
+	return lines
+}
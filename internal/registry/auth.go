@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+type tokenResponse struct {
+	Token       string `json:"token,omitempty"`
+	AccessToken string `json:"access_token,omitempty"`
+}
+
+// Parse a WWW-Authenticate header
+// ex) Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"
+func parseChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	header = strings.TrimSpace(header)
+	idx := strings.IndexByte(header, ' ')
+	if idx < 0 {
+		return strings.ToLower(header), params
+	}
+	scheme := strings.ToLower(header[:idx])
+	rest := header[idx+1:]
+
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// quoted value may contain commas (multiple scopes)
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end > len(rest) {
+				end = len(rest)
+			}
+			value = strings.ReplaceAll(rest[1:end], `\"`, `"`)
+			if end < len(rest) {
+				end++
+			}
+			rest = rest[end:]
+		} else {
+			comma := strings.IndexByte(rest, ',')
+			if comma < 0 {
+				comma = len(rest)
+			}
+			value = strings.TrimSpace(rest[:comma])
+			rest = rest[comma:]
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+func parseToken(body []byte) (string, error) {
+	token := tokenResponse{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	if token.AccessToken != "" {
+		return token.AccessToken, nil
+	}
+	return "", errors.New("token service returned an empty token")
+}
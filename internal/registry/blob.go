@@ -0,0 +1,177 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+const DEFAULT_CHUNK_SIZE = 16 << 20 // bytes sent by one upload PATCH
+
+// Whether the repository already holds the blob
+func (c *Client) BlobExists(name, digest string) (bool, error) {
+	req, err := c.NewRequest(http.MethodHead, fmt.Sprintf("/v2/%s/blobs/%s", name, digest), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.Do(req, pullScope(name))
+	if err != nil {
+		return false, err
+	}
+	drain(resp)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("registry %s returned %s for blob %s@%s", c.host, resp.Status, name, digest)
+}
+
+// Stream the blob, the caller closes the reader
+func (c *Client) GetBlob(name, digest string) (io.ReadCloser, int64, error) {
+	req, err := c.NewRequest(http.MethodGet, fmt.Sprintf("/v2/%s/blobs/%s", name, digest), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.Do(req, pullScope(name))
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		drain(resp)
+		return nil, 0, fmt.Errorf("registry %s returned %s for blob %s@%s", c.host, resp.Status, name, digest)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// Mount the blob from another repository of the same registry (cross-repo copy).
+// When the registry refuses the mount an upload session is opened instead, its location is returned.
+func (c *Client) MountBlob(name, digest, from string) (bool, string, error) {
+	query := url.Values{}
+	query.Set("mount", digest)
+	query.Set("from", from)
+	req, err := c.NewRequest(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/?%s", name, query.Encode()), nil)
+	if err != nil {
+		return false, "", err
+	}
+	resp, err := c.Do(req, pushScope(name)+" "+pullScope(from))
+	if err != nil {
+		return false, "", err
+	}
+	drain(resp)
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, "", nil
+	case http.StatusAccepted:
+		location, err := uploadLocation(resp)
+		return false, location, err
+	}
+	return false, "", fmt.Errorf("registry %s returned %s mounting %s from %s", c.host, resp.Status, digest, from)
+}
+
+// Upload the blob in chunks of chunkSize bytes. location is an upload session opened by
+// MountBlob, empty starts a new one.
+func (c *Client) UploadBlob(name, digest string, r io.Reader, location string, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_CHUNK_SIZE
+	}
+	scope := pushScope(name)
+	if location == "" {
+		req, err := c.NewRequest(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/", name), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.Do(req, scope)
+		if err != nil {
+			return err
+		}
+		drain(resp)
+		if resp.StatusCode != http.StatusAccepted {
+			return fmt.Errorf("registry %s returned %s starting upload of %s@%s", c.host, resp.Status, name, digest)
+		}
+		if location, err = uploadLocation(resp); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, chunkSize)
+	offset := 0
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+		if n > 0 {
+			req, err := c.locationRequest(http.MethodPatch, location, bytes.NewReader(buf[:n]))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+			resp, err := c.Do(req, scope)
+			if err != nil {
+				return err
+			}
+			drain(resp)
+			if resp.StatusCode != http.StatusAccepted {
+				return fmt.Errorf("registry %s returned %s uploading %s@%s", c.host, resp.Status, name, digest)
+			}
+			if location, err = uploadLocation(resp); err != nil {
+				return err
+			}
+			offset += n
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	// close the session with the digest, the registry verifies the content
+	req, err := c.locationRequest(http.MethodPut, location, nil)
+	if err != nil {
+		return err
+	}
+	query := req.URL.Query()
+	query.Set("digest", digest)
+	req.URL.RawQuery = query.Encode()
+	resp, err := c.Do(req, scope)
+	if err != nil {
+		return err
+	}
+	drain(resp)
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("registry %s returned %s completing upload of %s@%s", c.host, resp.Status, name, digest)
+	}
+	return nil
+}
+
+// Request to an upload location, relative to the registry or absolute
+func (c *Client) locationRequest(method, location string, body io.Reader) (*http.Request, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.IsAbs() {
+		return http.NewRequest(method, location, body)
+	}
+	return c.NewRequest(method, location, body)
+}
+
+func uploadLocation(resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("registry %s returned no upload location", resp.Request.URL.Host)
+	}
+	return location, nil
+}
+
+func pullScope(name string) string {
+	return fmt.Sprintf("repository:%s:pull", name)
+}
+
+func pushScope(name string) string {
+	return fmt.Sprintf("repository:%s:pull,push", name)
+}
@@ -1,62 +1,446 @@
 package registry
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gsheet-exporter/pkg/logger"
 )
 
+// Options for connecting to a registry server
+type Options struct {
+	Username string
+	Password string
+	CAFile   string // extra PEM bundle trusted for https
+	Insecure bool   // skip tls verification and fall back to plain http
+}
+
+// Docker Registry HTTP API v2 client
+type Client struct {
+	host     string
+	scheme   string
+	username string
+	password string
+	insecure bool
+
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	fallback bool              // https failed, plain http is used without credentials
+	basic    bool              // registry answered with a Basic challenge
+	tokens   map[string]string // scope -> bearer token
+}
+
 var (
 	log = logger.GetInstance()
 )
 
-// Health check registry server
-func Ping(url string) error {
-	srv := fmt.Sprintf("http://%s/v2", url)
-	resp, err := http.Get(srv)
+// Create a client from a "host[:port]" or "scheme://host[:port]" url.
+// Without a scheme https is used (plain http is tried when Insecure is set).
+func NewClient(url string, opts Options) (*Client, error) {
+	if url == "" {
+		return nil, errors.New("url is empty")
+	}
+	scheme := "https"
+	host := url
+	if idx := strings.Index(url, "://"); idx >= 0 {
+		scheme = url[:idx]
+		host = url[idx+3:]
+	}
+	host = strings.TrimSuffix(host, "/")
+	if scheme != "https" && scheme != "http" {
+		return nil, fmt.Errorf("unsupported scheme: %s", scheme)
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: opts.Insecure,
+	}
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
 
+	return &Client{
+		host:     host,
+		scheme:   scheme,
+		username: opts.Username,
+		password: opts.Password,
+		insecure: opts.Insecure,
+
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   5 * time.Minute,
+		},
+		tokens: map[string]string{},
+	}, nil
+}
+
+// Registry host (without scheme)
+func (c *Client) Host() string {
+	return c.host
+}
+
+// Build a request against the registry, path is relative to the host ("/v2/...")
+func (c *Client) NewRequest(method, path string, body io.Reader) (*http.Request, error) {
+	c.mu.Lock()
+	scheme := c.scheme
+	c.mu.Unlock()
+	return http.NewRequest(method, fmt.Sprintf("%s://%s%s", scheme, c.host, path), body)
+}
+
+// Send a request and answer the WWW-Authenticate challenge if the registry asks for one.
+// scope is the token scope requested from the auth service (e.g. "repository:nginx:pull").
+func (c *Client) Do(req *http.Request, scope string) (*http.Response, error) {
+	c.authorize(req, scope)
+	resp, err := c.send(req)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusOK {
-		_, err := io.ReadAll(resp.Body)
+	// 401: read the challenge, authenticate and try once more
+	header := resp.Header.Get("WWW-Authenticate")
+	drain(resp)
+	c.mu.Lock()
+	fallback := c.fallback
+	c.mu.Unlock()
+	if fallback {
+		return nil, fmt.Errorf("registry %s requires auth, credentials are not sent over the plain http fallback", c.host)
+	}
+	scheme, params := parseChallenge(header)
+	switch scheme {
+	case "basic":
+		if c.username == "" {
+			return nil, fmt.Errorf("registry %s requires basic auth but no credentials are set", c.host)
+		}
+		c.mu.Lock()
+		c.basic = true
+		c.mu.Unlock()
+	case "bearer":
+		// the token is requested for the challenged scope, cached under the requested one
+		// so the next request with that scope is authorized up front
+		tokenScope := scope
+		if params["scope"] != "" {
+			tokenScope = params["scope"]
+		}
+		token, err := c.fetchToken(params["realm"], params["service"], tokenScope)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		c.mu.Lock()
+		c.tokens[scope] = token
+		c.mu.Unlock()
+	default:
+		return nil, fmt.Errorf("registry %s: unsupported auth challenge %q", c.host, header)
 	}
-	return nil
+
+	retry, err := rewind(req)
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(retry, scope)
+	return c.send(retry)
 }
 
-// image list(no have image tags)
-func Catalog(url string) (string, error) {
-	srv := fmt.Sprintf("http://%s/v2/_catalog", url)
-	resp, err := http.Get(srv)
+// Health check registry server
+func (c *Client) Ping() error {
+	req, err := c.NewRequest(http.MethodGet, "/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry %s returned %s", c.host, resp.Status)
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// image list(no have image tags), one page at a time.
+// next is the "Link" url returned by the previous page, empty for the first page.
+func (c *Client) CatalogPage(next string, n int) (string, string, error) {
+	path := next
+	if path == "" {
+		path = fmt.Sprintf("/v2/_catalog?n=%d", n)
+	}
+	body, status, next, err := c.getPage(path, "registry:catalog:*")
+	if err != nil {
+		return "", "", err
+	}
+	if status != http.StatusOK {
+		return "", "", fmt.Errorf("registry %s returned %d: %s", c.host, status, body)
+	}
+	return body, next, nil
+}
+
+// image list tags, one page at a time.
+// Error bodies (e.g. NAME_UNKNOWN) are returned as is, callers parse the "errors" field.
+func (c *Client) TagsPage(image, next string, n int) (string, string, error) {
+	path := next
+	if path == "" {
+		path = fmt.Sprintf("/v2/%s/tags/list?n=%d", image, n)
+	}
+	body, _, next, err := c.getPage(path, fmt.Sprintf("repository:%s:pull", image))
+	if err != nil {
+		return "", "", err
+	}
+	return body, next, nil
+}
+
+// Digest of the manifest "name:ref" (ref is a tag or a digest) with a HEAD request.
+// found is false when the registry has no such manifest.
+func (c *Client) ManifestDigest(name, ref string) (string, bool, error) {
+	resp, err := c.manifest(http.MethodHead, name, ref)
+	if err != nil {
+		return "", false, err
+	}
+	drain(resp)
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("registry %s returned %s for %s:%s", c.host, resp.Status, name, ref)
+	}
+	if digest := resp.Header.Get(DIGEST_HEADER); digest != "" {
+		return digest, true, nil
+	}
+
+	// some registries omit the digest header on HEAD, hash the manifest itself
+	manifest, found, err := c.GetManifest(name, ref)
+	if err != nil || !found {
+		return "", found, err
+	}
+	return manifest.Digest, true, nil
+}
+
+// Fetch the manifest "name:ref", found is false when the registry has no such manifest
+func (c *Client) GetManifest(name, ref string) (*Manifest, bool, error) {
+	resp, err := c.manifest(http.MethodGet, name, ref)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("registry %s returned %s for %s:%s: %s", c.host, resp.Status, name, ref, string(bodyBytes))
+	}
+	digest := resp.Header.Get(DIGEST_HEADER)
+	if digest == "" {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(bodyBytes))
+	}
+	return &Manifest{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    digest,
+		Body:      bodyBytes,
+	}, true, nil
+}
 
+// Push the manifest under ref (a tag or its digest), the registry's digest is returned
+func (c *Client) PutManifest(name, ref, mediaType string, body []byte) (string, error) {
+	req, err := c.NewRequest(http.MethodPut, fmt.Sprintf("/v2/%s/manifests/%s", name, ref), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := c.Do(req, pushScope(name))
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
+	if resp.StatusCode != http.StatusCreated {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("registry %s returned %s pushing %s:%s: %s", c.host, resp.Status, name, ref, string(bodyBytes))
+	}
+	digest := resp.Header.Get(DIGEST_HEADER)
+	if digest == "" {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	}
+	return digest, nil
+}
+
+// Delete the manifest by digest (tags cannot be deleted), found is false when it does not exist
+func (c *Client) DeleteManifest(name, digest string) (bool, error) {
+	req, err := c.NewRequest(http.MethodDelete, fmt.Sprintf("/v2/%s/manifests/%s", name, digest), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.Do(req, fmt.Sprintf("repository:%s:delete", name))
+	if err != nil {
+		return false, err
+	}
+	drain(resp)
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("registry %s returned %s deleting %s@%s", c.host, resp.Status, name, digest)
+}
+
+func (c *Client) manifest(method, name, ref string) (*http.Response, error) {
+	req, err := c.NewRequest(method, fmt.Sprintf("/v2/%s/manifests/%s", name, ref), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", manifestAccept)
+	return c.Do(req, pullScope(name))
+}
+
+func (c *Client) getPage(path, scope string) (string, int, string, error) {
+	req, err := c.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return "", 0, "", err
+	}
+	resp, err := c.Do(req, scope)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, "", err
+	}
+	next, err := nextLink(resp)
+	if err != nil {
+		return "", 0, "", err
+	}
+	return string(bodyBytes), resp.StatusCode, next, nil
+}
+
+// Find the rel="next" target of a RFC5988 Link header
+// ex) Link: </v2/_catalog?last=b&n=100>; rel="next"
+func nextLink(resp *http.Response) (string, error) {
+	for _, header := range resp.Header.Values("Link") {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			isNext := false
+			for _, param := range parts[1:] {
+				param = strings.ReplaceAll(strings.TrimSpace(param), " ", "")
+				if param == `rel="next"` || param == "rel=next" {
+					isNext = true
+				}
+			}
+			if !isNext {
+				continue
+			}
+			// resolve against the request url, the registry may return a relative or absolute link
+			u, err := resp.Request.URL.Parse(target[1 : len(target)-1])
+			if err != nil {
+				return "", err
+			}
+			if u.Host != resp.Request.URL.Host {
+				return "", fmt.Errorf("registry %s returned a next link to another host: %s", resp.Request.URL.Host, u)
+			}
+			return u.RequestURI(), nil
 		}
-		bodyString := string(bodyBytes)
-		return bodyString, nil
 	}
 	return "", nil
 }
 
-// image list tags
-func ListTags(url string, image string) (string, error) {
-	srv := fmt.Sprintf("http://%s/v2/%s/tags/list", url, image)
-	resp, err := http.Get(srv)
+func (c *Client) authorize(req *http.Request, scope string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.fallback {
+		return
+	}
+	if token, ok := c.tokens[scope]; ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if c.basic {
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+// Send the request, falling back to plain http once when the registry is insecure
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err == nil || !c.insecure || req.URL.Scheme != "https" {
+		return resp, err
+	}
+
+	log.Warn.Printf("https request to %s failed (%v), retrying with http", c.host, err)
+	retry, rewindErr := rewind(req)
+	if rewindErr != nil {
+		return nil, err
+	}
+	retry.URL.Scheme = "http"
+	retry.Header.Del("Authorization")
+	resp, httpErr := c.httpClient.Do(retry)
+	if httpErr != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.scheme = "http"
+	c.fallback = true
+	c.mu.Unlock()
+	return resp, nil
+}
 
+// Request a bearer token from the registry's token service
+func (c *Client) fetchToken(realm, service, scope string) (string, error) {
+	if realm == "" {
+		return "", fmt.Errorf("registry %s: bearer challenge without realm", c.host)
+	}
+	req, err := http.NewRequest(http.MethodGet, realm, nil)
+	if err != nil {
+		return "", err
+	}
+	query := req.URL.Query()
+	if service != "" {
+		query.Set("service", service)
+	}
+	for _, s := range strings.Fields(scope) {
+		query.Add("scope", s)
+	}
+	req.URL.RawQuery = query.Encode()
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -66,7 +450,29 @@ func ListTags(url string, image string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	bodyString := string(bodyBytes)
-	return bodyString, nil
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token service %s returned %s: %s", realm, resp.Status, string(bodyBytes))
+	}
+	return parseToken(bodyBytes)
+}
+
+// Clone the request with a fresh body so it can be sent again
+func rewind(req *http.Request) (*http.Request, error) {
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, errors.New("request body cannot be replayed")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
 
+func drain(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
 }
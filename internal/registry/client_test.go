@@ -0,0 +1,190 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{
+			`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`,
+			"bearer",
+			map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/nginx:pull"},
+		},
+		{
+			// several scopes in one quoted value, unquoted values, spaces
+			`bearer realm="https://harbor/service/token", service=harbor-registry , scope="repository:a:pull,push repository:b:pull"`,
+			"bearer",
+			map[string]string{"realm": "https://harbor/service/token", "service": "harbor-registry", "scope": "repository:a:pull,push repository:b:pull"},
+		},
+		{`Basic realm="Registry Realm"`, "basic", map[string]string{"realm": "Registry Realm"}},
+		{`Basic`, "basic", map[string]string{}},
+		{`Bearer realm="quoted \"value\""`, "bearer", map[string]string{"realm": `quoted "value"`}},
+		{`Bearer realm="unterminated`, "bearer", map[string]string{"realm": "unterminated"}},
+		{``, "", map[string]string{}},
+	}
+	for _, test := range tests {
+		scheme, params := parseChallenge(test.header)
+		if scheme != test.scheme || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("parseChallenge(%q) = %q %v, want %q %v", test.header, scheme, params, test.scheme, test.params)
+		}
+	}
+}
+
+// Registry answering /v2/ paths and counting the requests of each kind
+type authServer struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	unauthorized int
+	tokens       int
+	tokenScopes  []string
+	auth         []string // Authorization header of every registry request
+}
+
+func (server *authServer) count(field *int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	*field++
+}
+
+// Registry asking for a bearer token, the challenge scope differs from the scope requested by the client
+func newBearerServer(t *testing.T) *authServer {
+	server := &authServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			server.mu.Lock()
+			server.tokens++
+			server.tokenScopes = append(server.tokenScopes, req.URL.Query().Get("scope"))
+			server.mu.Unlock()
+			user, pass, ok := req.BasicAuth()
+			if !ok || user != "robot" || pass != "r0bot-pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token":"t0ken"}`))
+			return
+		}
+		server.mu.Lock()
+		server.auth = append(server.auth, req.Header.Get("Authorization"))
+		server.mu.Unlock()
+		if req.Header.Get("Authorization") != "Bearer t0ken" {
+			server.count(&server.unauthorized)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test",scope="repository:org/app:*"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set(DIGEST_HEADER, "sha256:abcd")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBearerTokenCachedByRequestedScope(t *testing.T) {
+	server := newBearerServer(t)
+	client, err := NewClient(server.URL, Options{Username: "robot", Password: "r0bot-pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		digest, found, err := client.ManifestDigest("org/app", "1")
+		if err != nil || !found || digest != "sha256:abcd" {
+			t.Fatalf("ManifestDigest = %s %v %v", digest, found, err)
+		}
+	}
+	if server.unauthorized != 1 || server.tokens != 1 {
+		t.Errorf("%d challenges and %d token requests for 3 requests, want 1 and 1", server.unauthorized, server.tokens)
+	}
+	if server.tokenScopes[0] != "repository:org/app:*" {
+		t.Errorf("token requested for %q, want the challenged scope", server.tokenScopes[0])
+	}
+}
+
+func TestBearerTokenRefused(t *testing.T) {
+	server := newBearerServer(t)
+	client, err := NewClient(server.URL, Options{Username: "robot", Password: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.ManifestDigest("org/app", "1"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("ManifestDigest with a refused token: %v", err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	server := &authServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		server.mu.Lock()
+		server.auth = append(server.auth, req.Header.Get("Authorization"))
+		server.mu.Unlock()
+		if user, pass, ok := req.BasicAuth(); !ok || user != "robot" || pass != "r0bot-pass" {
+			server.count(&server.unauthorized)
+			w.Header().Set("WWW-Authenticate", `Basic realm="Registry Realm"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, Options{Username: "robot", Password: "r0bot-pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// challenged once, the credentials are sent up front afterwards
+	if server.unauthorized != 1 || len(server.auth) != 3 {
+		t.Errorf("%d challenges in %d requests", server.unauthorized, len(server.auth))
+	}
+
+	anonymous, err := NewClient(server.URL, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := anonymous.Ping(); err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("Ping without credentials: %v", err)
+	}
+}
+
+func TestInsecureFallbackSendsNoCredentials(t *testing.T) {
+	server := &authServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		server.mu.Lock()
+		server.auth = append(server.auth, req.Header.Get("Authorization"))
+		server.mu.Unlock()
+		w.Header().Set("WWW-Authenticate", `Basic realm="Registry Realm"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	// no scheme: https first, the plain http server only answers the fallback
+	client, err := NewClient(strings.TrimPrefix(server.URL, "http://"), Options{Username: "robot", Password: "r0bot-pass", Insecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.basic = true // credentials already accepted over https
+	err = client.Ping()
+	if err == nil || !strings.Contains(err.Error(), "plain http fallback") {
+		t.Errorf("Ping over the http fallback: %v", err)
+	}
+	for _, auth := range server.auth {
+		if auth != "" {
+			t.Errorf("credentials sent over plain http: %q", auth)
+		}
+	}
+	if len(server.auth) != 1 {
+		t.Errorf("%d requests over plain http, want 1", len(server.auth))
+	}
+}
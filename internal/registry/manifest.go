@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	MEDIA_TYPE_DOCKER_V2    = "application/vnd.docker.distribution.manifest.v2+json"
+	MEDIA_TYPE_DOCKER_LIST  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MEDIA_TYPE_DOCKER_V1    = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MEDIA_TYPE_OCI_MANIFEST = "application/vnd.oci.image.manifest.v1+json"
+	MEDIA_TYPE_OCI_INDEX    = "application/vnd.oci.image.index.v1+json"
+	DIGEST_HEADER           = "Docker-Content-Digest"
+
+	manifestAccept = MEDIA_TYPE_DOCKER_V2 + ", " + MEDIA_TYPE_DOCKER_LIST + ", " + MEDIA_TYPE_OCI_MANIFEST + ", " + MEDIA_TYPE_OCI_INDEX + ", " + MEDIA_TYPE_DOCKER_V1
+)
+
+// Image manifest as served by the registry
+type Manifest struct {
+	MediaType string
+	Digest    string
+	Body      []byte
+}
+
+// Content reference of a manifest (config, layer or listed manifest)
+type Descriptor struct {
+	MediaType string    `json:"mediaType,omitempty"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size,omitempty"`
+	URLs      []string  `json:"urls,omitempty"` // foreign layers are pulled from these, not the registry
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Fields of image manifests (docker v2, oci, schema1) and lists
+type manifestBody struct {
+	MediaType string       `json:"mediaType,omitempty"`
+	Config    *Descriptor  `json:"config,omitempty"`
+	Layers    []Descriptor `json:"layers,omitempty"`
+	Manifests []Descriptor `json:"manifests,omitempty"`
+	FSLayers  []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers,omitempty"`
+}
+
+// Manifest list (docker) or image index (oci) of a multi-arch image
+func (m *Manifest) IsList() bool {
+	mediaType := m.Type()
+	return mediaType == MEDIA_TYPE_DOCKER_LIST || mediaType == MEDIA_TYPE_OCI_INDEX
+}
+
+// Manifests of a list, one per platform
+func (m *Manifest) Children() ([]Descriptor, error) {
+	body := manifestBody{}
+	if err := json.Unmarshal(m.Body, &body); err != nil {
+		return nil, err
+	}
+	return body.Manifests, nil
+}
+
+// Config blob of an image manifest, nil for lists and schema1 manifests
+func (m *Manifest) Config() (*Descriptor, error) {
+	body := manifestBody{}
+	if err := json.Unmarshal(m.Body, &body); err != nil {
+		return nil, err
+	}
+	return body.Config, nil
+}
+
+// Config and layer blobs stored in the registry, foreign layers are left out
+func (m *Manifest) Blobs() ([]Descriptor, error) {
+	body := manifestBody{}
+	if err := json.Unmarshal(m.Body, &body); err != nil {
+		return nil, err
+	}
+	blobs := []Descriptor{}
+	seen := map[string]bool{}
+	add := func(blob Descriptor) {
+		if blob.Digest == "" || seen[blob.Digest] || len(blob.URLs) > 0 {
+			return
+		}
+		seen[blob.Digest] = true
+		blobs = append(blobs, blob)
+	}
+	if body.Config != nil {
+		add(*body.Config)
+	}
+	for _, layer := range body.Layers {
+		add(layer)
+	}
+	// schema1 lists the layers from the top, with repeated empty layers
+	for _, layer := range body.FSLayers {
+		add(Descriptor{Digest: layer.BlobSum})
+	}
+	return blobs, nil
+}
+
+// Content-Type of the response, or the mediaType field when the registry sent a generic type
+func (m *Manifest) Type() string {
+	mediaType := strings.TrimSpace(strings.Split(m.MediaType, ";")[0])
+	if strings.HasPrefix(mediaType, "application/vnd.") {
+		return mediaType
+	}
+	body := manifestBody{}
+	if err := json.Unmarshal(m.Body, &body); err == nil && body.MediaType != "" {
+		return body.MediaType
+	}
+	return mediaType
+}
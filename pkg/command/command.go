@@ -1,9 +1,12 @@
 package command
 
-import "os/exec"
+import (
+	"context"
 
-func Run(cmdString string) (string, error) {
-	cmd := exec.Command("sh", "-c", cmdString)
-	output, err := cmd.CombinedOutput()
-	return string(output), err
+	"github.com/gsheet-exporter/internal/command"
+)
+
+// Run the program with args (no shell) and return stdout followed by stderr
+func Run(ctx context.Context, name string, args ...string) (string, error) {
+	return command.Output(ctx, command.ExecExecutor{}, command.New(name, args...))
 }
@@ -0,0 +1,235 @@
+package gsheet
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Sheet column of each row field: a column letter ("col:C") or a header name ("Image").
+// Without any read column the range is positional: [image, export], digest and platform
+// columns are only read when given.
+type Columns struct {
+	Image    string
+	Export   string
+	Target   string // mirror repository override
+	Platform string
+	Comment  string
+	Digest   string
+
+	// written back by sync, nothing is written without a status column
+	Status    string // "synced", "missing tag", "copy failed: unauthorized"
+	Timestamp string // last sync time
+	Mirrored  string // digest stored in the mirror
+}
+
+// Position of a read range in its sheet ("CK1!C2:D" -> CK1, column 2, row 2)
+type sheetRange struct {
+	Sheet    string
+	Column   int // 0: A
+	StartRow int // 1-based, 0 when the range has no row ("CK1!C:F")
+}
+
+// field -> column index in the range values, NO_COLUMN when not mapped
+type columnIndex map[string]int
+
+const NO_COLUMN = -1 << 16
+
+// Prefix of a column given by letter ("col:C"), a bare "OS" or "ID" is a header name
+const COLUMN_LETTER_PREFIX = "col:"
+
+const (
+	FIELD_IMAGE    = "image"
+	FIELD_EXPORT   = "export"
+	FIELD_TARGET   = "target"
+	FIELD_PLATFORM = "platform"
+	FIELD_COMMENT  = "comment"
+	FIELD_DIGEST   = "digest"
+
+	FIELD_STATUS    = "status"
+	FIELD_TIMESTAMP = "timestamp"
+	FIELD_MIRRORED  = "mirrored"
+)
+
+var (
+	columnLetterRegexp = regexp.MustCompile(`^[A-Z]{1,3}$`)
+	cellRegexp         = regexp.MustCompile(`^([A-Za-z]*)([0-9]*)$`)
+
+	positionalColumns = columnIndex{FIELD_IMAGE: 0, FIELD_EXPORT: 1}
+	writtenFields     = map[string]bool{FIELD_STATUS: true, FIELD_TIMESTAMP: true, FIELD_MIRRORED: true}
+)
+
+// Parse "image=col:C,export=Export,target=Target Repo,platform=col:F,comment=Notes,digest=Digest,status=col:H".
+// "col:" columns are column letters (up to 3), anything else a header name.
+func ParseColumns(spec string) (Columns, error) {
+	columns := Columns{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[1]) == "" {
+			return columns, fmt.Errorf("invalid column: %s", item)
+		}
+		column := strings.TrimSpace(kv[1])
+		if letters, ok := columnLetters(column); ok {
+			if !columnLetterRegexp.MatchString(letters) {
+				return columns, fmt.Errorf("invalid column letter: %s", item)
+			}
+			column = COLUMN_LETTER_PREFIX + letters
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case FIELD_IMAGE:
+			columns.Image = column
+		case FIELD_EXPORT:
+			columns.Export = column
+		case FIELD_TARGET:
+			columns.Target = column
+		case FIELD_PLATFORM:
+			columns.Platform = column
+		case FIELD_COMMENT:
+			columns.Comment = column
+		case FIELD_DIGEST:
+			columns.Digest = column
+		case FIELD_STATUS:
+			columns.Status = column
+		case FIELD_TIMESTAMP:
+			columns.Timestamp = column
+		case FIELD_MIRRORED:
+			columns.Mirrored = column
+		default:
+			return columns, fmt.Errorf("unknown column field: %s", kv[0])
+		}
+	}
+	if columns.positional() {
+		return columns, nil
+	}
+	if columns.Image == "" {
+		return columns, fmt.Errorf("image column is required")
+	}
+	return columns, nil
+}
+
+// No read column is set, the written columns may be
+func (columns Columns) positional() bool {
+	return columns.Image == "" && columns.Export == "" && columns.Target == "" && columns.Platform == "" &&
+		columns.Comment == "" && columns.Digest == ""
+}
+
+func (columns Columns) fields() map[string]string {
+	return map[string]string{
+		FIELD_IMAGE:     columns.Image,
+		FIELD_EXPORT:    columns.Export,
+		FIELD_TARGET:    columns.Target,
+		FIELD_PLATFORM:  columns.Platform,
+		FIELD_COMMENT:   columns.Comment,
+		FIELD_DIGEST:    columns.Digest,
+		FIELD_STATUS:    columns.Status,
+		FIELD_TIMESTAMP: columns.Timestamp,
+		FIELD_MIRRORED:  columns.Mirrored,
+	}
+}
+
+// Whether a column is given by header name, the header row must be read
+func (columns Columns) hasHeader() bool {
+	for _, column := range columns.fields() {
+		if _, ok := columnLetters(column); column != "" && !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Index of every field in the range values, header names are looked up in header
+func (columns Columns) resolve(rng sheetRange, header []string) (columnIndex, error) {
+	index := columnIndex{}
+	for field, column := range columns.fields() {
+		index[field] = NO_COLUMN
+		if idx, ok := positionalColumns[field]; ok && columns.positional() {
+			index[field] = idx
+		}
+		if column == "" {
+			continue
+		}
+		if letters, ok := columnLetters(column); ok {
+			idx := columnNumber(letters) - rng.Column
+			// written columns may be outside of the read range
+			if idx < 0 && !writtenFields[field] {
+				return nil, fmt.Errorf("%s column %s is left of the range %s", field, column, rng.Sheet)
+			}
+			index[field] = idx
+			continue
+		}
+		found := false
+		for idx, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				index[field], found = idx, true
+				break
+			}
+		}
+		if !found && columnLetterRegexp.MatchString(column) {
+			return nil, fmt.Errorf("%s column %q not found in the header of %s, use %s%s for a column letter", field, column, rng.Sheet, COLUMN_LETTER_PREFIX, column)
+		}
+		if !found {
+			return nil, fmt.Errorf("%s column %q not found in the header of %s", field, column, rng.Sheet)
+		}
+	}
+	return index, nil
+}
+
+// Letters of a "col:C" column, upper cased
+func columnLetters(column string) (string, bool) {
+	if len(column) < len(COLUMN_LETTER_PREFIX) || !strings.EqualFold(column[:len(COLUMN_LETTER_PREFIX)], COLUMN_LETTER_PREFIX) {
+		return "", false
+	}
+	return strings.ToUpper(strings.TrimSpace(column[len(COLUMN_LETTER_PREFIX):])), true
+}
+
+// Parse the A1 notation of a read range ("CK1!C2:D", "'Release 1'!B:F")
+func parseRange(readRange string) (sheetRange, error) {
+	rng := sheetRange{}
+	cells := readRange
+	if idx := strings.LastIndex(readRange, "!"); idx >= 0 {
+		rng.Sheet = strings.Trim(readRange[:idx], "'")
+		cells = readRange[idx+1:]
+	}
+	start := strings.Split(cells, ":")[0]
+	match := cellRegexp.FindStringSubmatch(strings.TrimSpace(start))
+	if match == nil {
+		return rng, fmt.Errorf("invalid range: %s", readRange)
+	}
+	if match[1] != "" {
+		rng.Column = columnNumber(strings.ToUpper(match[1]))
+	}
+	if match[2] != "" {
+		rng.StartRow, _ = strconv.Atoi(match[2])
+	}
+	return rng, nil
+}
+
+// "A" -> 0, "C" -> 2, "AA" -> 26
+func columnNumber(letters string) int {
+	n := 0
+	for _, letter := range letters {
+		n = n*26 + int(letter-'A'+1)
+	}
+	return n - 1
+}
+
+// 0 -> "A", 26 -> "AA"
+func columnLetter(n int) string {
+	letters := ""
+	for n++; n > 0; n = (n - 1) / 26 {
+		letters = string(rune('A'+(n-1)%26)) + letters
+	}
+	return letters
+}
+
+func cell(values []interface{}, idx int) string {
+	if idx < 0 || idx >= len(values) {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprint(values[idx]))
+}
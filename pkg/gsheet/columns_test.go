@@ -0,0 +1,62 @@
+package gsheet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestColumnLettersNeedPrefix(t *testing.T) {
+	columns, err := ParseColumns("image=col:c,export=Export,platform=OS,digest=ID,status=col:H")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !columns.hasHeader() {
+		t.Fatal("header names are not read from the header row")
+	}
+	// range starting at column B
+	index, err := columns.resolve(sheetRange{Sheet: "CK1", Column: 1}, []string{"Name", "Image", "Export", "ID", "OS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{FIELD_IMAGE: 1, FIELD_EXPORT: 2, FIELD_DIGEST: 3, FIELD_PLATFORM: 4, FIELD_STATUS: 6, FIELD_TARGET: NO_COLUMN}
+	for field, idx := range want {
+		if index[field] != idx {
+			t.Errorf("%s column index = %d, want %d", field, index[field], idx)
+		}
+	}
+}
+
+func TestColumnLetterWithoutPrefixIsHeader(t *testing.T) {
+	columns, err := ParseColumns("image=C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = columns.resolve(sheetRange{Sheet: "CK1"}, []string{"Image"})
+	if err == nil || !strings.Contains(err.Error(), "col:C") {
+		t.Errorf("missing header C resolved: %v", err)
+	}
+}
+
+func TestInvalidColumnLetter(t *testing.T) {
+	for _, spec := range []string{"image=col:", "image=col:ABCD", "image=col:C1"} {
+		if _, err := ParseColumns(spec); err == nil {
+			t.Errorf("ParseColumns(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestPositionalColumnsAreImageAndExport(t *testing.T) {
+	index, err := Columns{Status: "col:H"}.resolve(sheetRange{Sheet: "CK1", Column: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// notes in the columns right of export are not read as digest or platform
+	rows := parseRows("CK1!C2:F", sheetRange{Sheet: "CK1", Column: 2, StartRow: 2}, index, ExportFlag{},
+		[][]interface{}{{"nginx:1.25", "", "checked by ops", "see ticket"}})
+	if len(rows) != 1 {
+		t.Fatalf("%d rows", len(rows))
+	}
+	if rows[0].Image != "nginx:1.25" || rows[0].Digest != "" || rows[0].Platform != "" || rows[0].Error != "" {
+		t.Errorf("positional row %+v", rows[0])
+	}
+}
@@ -0,0 +1,189 @@
+package gsheet
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gsheet-exporter/pkg/registry"
+	"github.com/gsheet-exporter/pkg/skopeo"
+)
+
+// How rows listing the same image with different export values are resolved
+const (
+	CONFLICT_EXCLUDE = "exclude" // an exclusion anywhere wins
+	CONFLICT_INCLUDE = "include" // an inclusion anywhere wins
+	CONFLICT_FIRST   = "first"   // the first row in range order wins
+	CONFLICT_LAST    = "last"    // the last row in range order wins
+	CONFLICT_ERROR   = "error"   // every conflicting row is rejected
+)
+
+const (
+	DIAGNOSTIC_DUPLICATE = "duplicate"
+	DIAGNOSTIC_CONFLICT  = "conflict"
+)
+
+var ConflictRules = []string{CONFLICT_EXCLUDE, CONFLICT_INCLUDE, CONFLICT_FIRST, CONFLICT_LAST, CONFLICT_ERROR}
+
+// Image listed by several rows, within a range or across ranges
+type Diagnostic struct {
+	Kind   string   `json:"kind"` // DIAGNOSTIC_DUPLICATE or DIAGNOSTIC_CONFLICT
+	Image  string   `json:"image"`
+	Rows   []string `json:"rows"`   // "CK1!C2:D line 3"
+	Result string   `json:"result"` // how it was resolved
+}
+
+// Location of the row for people
+func (row Row) Location() string {
+	return fmt.Sprintf("%s line %d", row.Range, row.Line)
+}
+
+// Keep one row per image. Duplicates keep their first row, export conflicts are resolved by rule.
+// The other rows are marked Ignored (or Error for CONFLICT_ERROR).
+// Rows copying the image to another target or platform are a conflict no rule decides
+// (the rules choose between export values), every such row is rejected, as are the rows of
+// different images copied to the same mirror tag. Rejected rows keep their mirrored images.
+func resolveDuplicates(rows []Row, rule string) ([]Row, []Diagnostic) {
+	diagnostics := []Diagnostic{}
+	groups := map[string][]int{}
+	order := []string{}
+	for idx, row := range rows {
+		if row.Error != "" {
+			continue
+		}
+		if _, ok := groups[row.Image]; !ok {
+			order = append(order, row.Image)
+		}
+		groups[row.Image] = append(groups[row.Image], idx)
+	}
+
+	for _, image := range order {
+		group := groups[image]
+		if len(group) < 2 {
+			continue
+		}
+		locations := []string{}
+		conflict, settings := false, false
+		for _, idx := range group {
+			locations = append(locations, rows[idx].Location())
+			conflict = conflict || rows[idx].Export != rows[group[0]].Export
+			settings = settings || !sameSettings(rows[idx], rows[group[0]])
+		}
+		diagnostic := Diagnostic{Kind: DIAGNOSTIC_DUPLICATE, Image: image, Rows: locations}
+
+		if settings {
+			diagnostic.Kind = DIAGNOSTIC_CONFLICT
+			for _, idx := range group {
+				rows[idx].Error = "conflicting target or platform in " + strings.Join(locations, ", ")
+			}
+			diagnostic.Result = "rejected, different target or platform"
+			log.Warn.Printf("Conflicting target or platform of %s: %s, rejected", image, strings.Join(locations, ", "))
+			diagnostics = append(diagnostics, diagnostic)
+			continue
+		}
+
+		winner := group[0]
+		if conflict {
+			diagnostic.Kind = DIAGNOSTIC_CONFLICT
+			if rule == CONFLICT_ERROR {
+				for _, idx := range group {
+					rows[idx].Error = "conflicting export values in " + strings.Join(locations, ", ")
+				}
+				diagnostic.Result = "rejected"
+				log.Warn.Printf("Conflicting export values of %s: %s, rejected", image, strings.Join(locations, ", "))
+				diagnostics = append(diagnostics, diagnostic)
+				continue
+			}
+			winner = conflictWinner(rows, group, rule)
+		}
+		for _, idx := range group {
+			if idx == winner {
+				continue
+			}
+			if conflict {
+				rows[idx].Ignored = fmt.Sprintf("conflict resolved by rule %s: %s", rule, rows[winner].Location())
+			} else {
+				rows[idx].Ignored = "duplicate of " + rows[winner].Location()
+			}
+		}
+		diagnostic.Result = fmt.Sprintf("%s kept (export %t)", rows[winner].Location(), rows[winner].Export)
+		log.Warn.Printf("Image %s listed %d times (%s) in %s, %s", image, len(group), diagnostic.Kind, strings.Join(locations, ", "), diagnostic.Result)
+		diagnostics = append(diagnostics, diagnostic)
+	}
+	return rows, append(diagnostics, mirrorCollisions(rows)...)
+}
+
+// Reject the rows of different images copied to the same mirror "repository:tag"
+// (ex. two images with the same target), each copy would overwrite the other.
+func mirrorCollisions(rows []Row) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	groups := map[string][]int{}
+	order := []string{}
+	for idx, row := range rows {
+		if row.Error != "" || row.Ignored != "" {
+			continue
+		}
+		ref, err := registry.ParseNormalized(row.Image)
+		if err != nil {
+			continue
+		}
+		mirrorTag := ref.MirrorTag(row.Target)
+		if mirrorTag == "" {
+			continue
+		}
+		if _, ok := groups[mirrorTag]; !ok {
+			order = append(order, mirrorTag)
+		}
+		groups[mirrorTag] = append(groups[mirrorTag], idx)
+	}
+
+	for _, mirrorTag := range order {
+		group := groups[mirrorTag]
+		if len(group) < 2 {
+			continue
+		}
+		locations := []string{}
+		for _, idx := range group {
+			locations = append(locations, fmt.Sprintf("%s (%s)", rows[idx].Location(), rows[idx].Image))
+		}
+		for _, idx := range group {
+			rows[idx].Error = fmt.Sprintf("mirror %s is the target of %s", mirrorTag, strings.Join(locations, ", "))
+		}
+		log.Warn.Printf("Images copied to the same mirror %s: %s, rejected", mirrorTag, strings.Join(locations, ", "))
+		diagnostics = append(diagnostics, Diagnostic{Kind: DIAGNOSTIC_CONFLICT, Image: mirrorTag, Rows: locations, Result: "rejected, same mirror repository and tag"})
+	}
+	return diagnostics
+}
+
+// Whether both rows copy the image to the same mirror repository and platforms
+func sameSettings(row, other Row) bool {
+	if row.Target != other.Target {
+		return false
+	}
+	return rowCopyMode(row) == rowCopyMode(other)
+}
+
+// Normalized platform cell, empty uses the global copy mode
+func rowCopyMode(row Row) string {
+	if row.Platform == "" {
+		return ""
+	}
+	mode, _ := skopeo.ParseCopyMode(row.Platform)
+	return mode
+}
+
+func conflictWinner(rows []Row, group []int, rule string) int {
+	switch rule {
+	case CONFLICT_FIRST:
+		return group[0]
+	case CONFLICT_LAST:
+		return group[len(group)-1]
+	}
+	// CONFLICT_EXCLUDE (default) or CONFLICT_INCLUDE: the first row with the winning value
+	want := rule == CONFLICT_INCLUDE
+	for _, idx := range group {
+		if rows[idx].Export == want {
+			return idx
+		}
+	}
+	return group[0]
+}
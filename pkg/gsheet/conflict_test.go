@@ -0,0 +1,66 @@
+package gsheet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveDuplicates(t *testing.T) {
+	rows := []Row{
+		{Range: "CK1!C2:D", Line: 2, Image: "nginx:1.25", Export: true},
+		{Range: "CK1!C2:D", Line: 3, Image: "nginx:1.25", Export: true},
+		{Range: "CK1!C2:D", Line: 4, Image: "redis:7", Export: true},
+		{Range: "CK2!C2:D", Line: 2, Image: "redis:7", Export: false},
+		{Range: "CK1!C2:D", Line: 5, Image: "app:1", Export: true, Platform: "linux/amd64"},
+		{Range: "CK2!C2:D", Line: 3, Image: "app:1", Export: true, Platform: "Linux/ARM64"},
+		{Range: "CK1!C2:D", Line: 6, Image: "tool:1", Export: true},
+		{Range: "CK2!C2:D", Line: 4, Image: "tool:1", Export: true, Target: "mirror/tool"},
+		{Range: "CK1!C2:D", Line: 7, Image: "db:1", Export: true, Platform: "linux/arm64"},
+		{Range: "CK2!C2:D", Line: 5, Image: "db:1", Export: true, Platform: " LINUX/arm64 "},
+	}
+	rows, diagnostics := resolveDuplicates(rows, CONFLICT_EXCLUDE)
+
+	want := []struct{ ignored, err bool }{
+		{false, false}, {true, false}, // duplicate
+		{true, false}, {false, false}, // export conflict, the exclusion wins
+		{false, true}, {false, true}, // platform conflict
+		{false, true}, {false, true}, // target conflict
+		{false, false}, {true, false}, // same platform written differently
+	}
+	for idx, row := range rows {
+		if (row.Ignored != "") != want[idx].ignored || (row.Error != "") != want[idx].err {
+			t.Errorf("%s %s: ignored %q, error %q", row.Location(), row.Image, row.Ignored, row.Error)
+		}
+	}
+
+	kinds := []string{}
+	for _, diagnostic := range diagnostics {
+		kinds = append(kinds, diagnostic.Image+" "+diagnostic.Kind)
+	}
+	wantKinds := "nginx:1.25 duplicate|redis:7 conflict|app:1 conflict|tool:1 conflict|db:1 duplicate"
+	if strings.Join(kinds, "|") != wantKinds {
+		t.Errorf("diagnostics %q, want %q", strings.Join(kinds, "|"), wantKinds)
+	}
+}
+
+func TestMirrorCollisions(t *testing.T) {
+	rows := []Row{
+		{Range: "CK1!C2:D", Line: 2, Image: "app:1", Export: true, Target: "team/app"},
+		{Range: "CK1!C2:D", Line: 3, Image: "quay.io/org/app:1", Export: true, Target: "team/app"},
+		{Range: "CK1!C2:D", Line: 4, Image: "quay.io/org/app:2", Export: true, Target: "team/app"},
+		// the familiar name of another image
+		{Range: "CK1!C2:D", Line: 5, Image: "nginx:1.25", Export: true},
+		{Range: "CK1!C2:D", Line: 6, Image: "quay.io/org/nginx:1.25", Export: false, Target: "nginx"},
+	}
+	rows, diagnostics := resolveDuplicates(rows, CONFLICT_EXCLUDE)
+
+	rejected := []bool{true, true, false, true, true}
+	for idx, row := range rows {
+		if (row.Error != "") != rejected[idx] {
+			t.Errorf("%s %s: error %q", row.Location(), row.Image, row.Error)
+		}
+	}
+	if len(diagnostics) != 2 || diagnostics[0].Image != "team/app:1" || diagnostics[1].Image != "nginx:1.25" {
+		t.Errorf("diagnostics %+v", diagnostics)
+	}
+}
@@ -0,0 +1,57 @@
+package gsheet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Values of the export flag column, compared case-insensitively.
+// Without values the defaults are used, an empty cell exports the row unless EmptyExclude is set.
+type ExportFlag struct {
+	True         []string
+	False        []string
+	EmptyExclude bool
+}
+
+var (
+	// checkbox cells read as TRUE/FALSE, typed values in english and korean
+	DEFAULT_EXPORT_TRUE  = []string{"true", "yes", "y", "1", "o", "v", "on", "export", "예", "네"}
+	DEFAULT_EXPORT_FALSE = []string{"false", "no", "n", "0", "x", "off", "skip", "아니오", "아니요"}
+)
+
+// Parse a comma separated value list ("TRUE,yes,1"), empty keeps the default
+func ParseFlagValues(spec string) []string {
+	values := []string{}
+	for _, value := range strings.Split(spec, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Whether the cell exports the row, unrecognized values are an error instead of a guess
+func (flag ExportFlag) Parse(value string) (bool, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return !flag.EmptyExclude, nil
+	}
+	truthy, falsy := flag.True, flag.False
+	if len(truthy) == 0 {
+		truthy = DEFAULT_EXPORT_TRUE
+	}
+	if len(falsy) == 0 {
+		falsy = DEFAULT_EXPORT_FALSE
+	}
+	for _, t := range truthy {
+		if strings.EqualFold(value, t) {
+			return true, nil
+		}
+	}
+	for _, f := range falsy {
+		if strings.EqualFold(value, f) {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("unrecognized export value %q", value)
+}
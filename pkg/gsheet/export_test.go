@@ -0,0 +1,96 @@
+package gsheet
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportFlagParse(t *testing.T) {
+	defaults := ExportFlag{}
+	custom := ExportFlag{True: []string{"ship", "O"}, False: []string{"hold"}, EmptyExclude: true}
+	tests := []struct {
+		flag  ExportFlag
+		value string
+		want  bool
+	}{
+		{defaults, "", true},
+		{defaults, "  ", true},
+		{defaults, "TRUE", true},
+		{defaults, "FALSE", false},
+		{defaults, " Yes ", true},
+		{defaults, "n", false},
+		{defaults, "1", true},
+		{defaults, "0", false},
+		{defaults, "o", true},
+		{defaults, "X", false},
+		{defaults, "예", true},
+		{defaults, "아니오", false},
+		{custom, "", false},
+		{custom, "Ship", true},
+		{custom, "o", true},
+		{custom, "HOLD", false},
+	}
+	for _, test := range tests {
+		got, err := test.flag.Parse(test.value)
+		if err != nil || got != test.want {
+			t.Errorf("%+v.Parse(%q) = %v, %v, want %v", test.flag, test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestExportFlagParseUnrecognized(t *testing.T) {
+	custom := ExportFlag{True: []string{"ship"}, False: []string{"hold"}}
+	for _, test := range []struct {
+		flag  ExportFlag
+		value string
+	}{
+		{ExportFlag{}, "maybe"},
+		{ExportFlag{}, "tru"},
+		{ExportFlag{}, "yes please"},
+		{ExportFlag{}, "2"},
+		{ExportFlag{}, "-"},
+		// custom values replace the defaults
+		{custom, "true"},
+		{custom, "false"},
+	} {
+		if got, err := test.flag.Parse(test.value); err == nil || !strings.Contains(err.Error(), "unrecognized export value") {
+			t.Errorf("%+v.Parse(%q) = %v, %v, want an error", test.flag, test.value, got, err)
+		}
+	}
+}
+
+func TestParseFlagValues(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"", []string{}},
+		{" , ,", []string{}},
+		{"TRUE,yes, 1 ", []string{"TRUE", "yes", "1"}},
+	}
+	for _, test := range tests {
+		if got := ParseFlagValues(test.spec); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseFlagValues(%q) = %q, want %q", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestUnrecognizedExportMakesRowInvalid(t *testing.T) {
+	index, err := Columns{}.resolve(sheetRange{Sheet: "CK1", Column: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := parseRows("CK1!C2:D", sheetRange{Sheet: "CK1", Column: 2, StartRow: 2}, index, ExportFlag{},
+		[][]interface{}{{"nginx:1.25", "maybe"}, {"redis:7", false}, {"app:1"}})
+	if len(rows) != 3 {
+		t.Fatalf("%d rows", len(rows))
+	}
+	if !strings.Contains(rows[0].Error, `"maybe"`) || rows[0].Export {
+		t.Errorf("row with an unrecognized export value %+v", rows[0])
+	}
+	// checkbox cells come as booleans, an empty cell exports by default
+	if rows[1].Error != "" || rows[1].Export || rows[2].Error != "" || !rows[2].Export {
+		t.Errorf("rows %+v %+v", rows[1], rows[2])
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/gsheet-exporter/pkg/logger"
+	"github.com/gsheet-exporter/pkg/registry"
+	"github.com/gsheet-exporter/pkg/skopeo"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
@@ -18,11 +21,16 @@ type Gsheet struct {
 	SpreadsheetId     string
 	ReadRange         string
 	WriteRange        string
+	Columns           Columns    // row fields of ReadRange, positional when empty
+	ExportFlag        ExportFlag // values of the export column
+	ConflictRule      string     // CONFLICT_* resolving an image listed by several rows
 
 	Service *sheets.Service
 	Ctx     context.Context
 }
 
+const TIMESTAMP_FORMAT = "2006-01-02 15:04:05"
+
 var (
 	log = logger.GetInstance()
 )
@@ -58,30 +66,130 @@ func NewGsheet(googleCredentials, spreadsheetId, readRange, writeRange string) (
 	}, nil
 }
 
-// Read image list in google sheet
+// One image row of the target sheet
+type Row struct {
+	Range  string `json:"range"` // read range the row belongs to
+	Index  int    `json:"index"` // row offset in the range (0: first row)
+	Line   int    `json:"line"`  // sheet row number (1: first row of the sheet)
+	Image  string `json:"image"` // normalized, "@digest" appended from the digest column
+	Export bool   `json:"export"`
+	Digest string `json:"digest,omitempty"`
+
+	// platforms copied from a manifest list ("all", "linux/arm64"), empty uses the global mode
+	Platform string `json:"platform,omitempty"`
+	Target   string `json:"target,omitempty"` // mirror repository, empty uses the image name
+	Comment  string `json:"comment,omitempty"`
+
+	// validation error, the row is neither copied nor exported
+	Error   string `json:"error,omitempty"`
+	Warning string `json:"warning,omitempty"` // accepted with a default (ex. missing tag)
+	Ignored string `json:"ignored,omitempty"` // another row of the same image is used
+
+	// where the row is, to write its status back
+	sheet   string
+	column  int // first column of the range
+	columns columnIndex
+}
+
+// Sync result written back next to a row
+type RowStatus struct {
+	Status string // "synced", "missing tag", "copy failed: unauthorized"
+	Digest string // digest stored in the mirror
+	Time   time.Time
+}
+
+// Read image list in google sheet, invalid and duplicate rows are left out
 func (gsheet *Gsheet) GetGsheet() ([]string, []string, error) {
+	rows, _, err := gsheet.GetRows()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	imageList := []string{}
+	exceptImageList := []string{}
+	for _, row := range rows {
+		if row.Error != "" || row.Ignored != "" {
+			continue
+		}
+		if row.Export {
+			imageList = append(imageList, row.Image)
+		} else {
+			exceptImageList = append(exceptImageList, row.Image)
+		}
+	}
+	return imageList, exceptImageList, nil
+}
+
+// Read image rows of every read range in google sheet.
+// An image listed by several rows is kept once, the diagnostics tell which rows were ignored.
+func (gsheet *Gsheet) GetRows() ([]Row, []Diagnostic, error) {
 
 	// Instance information set
 	spreadsheetId := gsheet.SpreadsheetId
 	readRange := strings.Split(gsheet.ReadRange, ",")
 	srv := gsheet.Service
 
-	imageList := []string{}
-	exceptImageList := []string{}
-
+	rows := []Row{}
 	for _, readRangeValue := range readRange {
+		readRangeValue = strings.TrimSpace(readRangeValue)
+		rng, err := parseRange(readRangeValue)
+		if err != nil {
+			return nil, nil, err
+		}
 		resp, err := srv.Spreadsheets.Values.Get(spreadsheetId, readRangeValue).Do()
 		if err != nil {
 			log.Error.Printf("Unable to retrieve data from sheet: %v", err)
 			return nil, nil, err
 		}
+		values := resp.Values
+
+		// header names are in the row above the range, or in its first row
+		header := []string{}
+		if gsheet.Columns.hasHeader() {
+			if rng.StartRow > 1 {
+				if header, err = gsheet.headerRow(rng); err != nil {
+					return nil, nil, err
+				}
+			} else if len(values) > 0 {
+				for _, name := range values[0] {
+					header = append(header, fmt.Sprint(name))
+				}
+				values = values[1:]
+				rng.StartRow = 2
+			}
+		}
+		index, err := gsheet.Columns.resolve(rng, header)
+		if err != nil {
+			return nil, nil, err
+		}
 		// google sheet read, then parse image list func
-		parseImgList, parseExImgList := parseImageList(resp)
+		rows = append(rows, parseRows(readRangeValue, rng, index, gsheet.ExportFlag, values)...)
+	}
+	rows, diagnostics := resolveDuplicates(rows, gsheet.ConflictRule)
+	return rows, diagnostics, nil
+}
 
-		imageList = append(imageList, parseImgList...)
-		exceptImageList = append(exceptImageList, parseExImgList...)
+// Header names above the range, from its first column
+func (gsheet *Gsheet) headerRow(rng sheetRange) ([]string, error) {
+	headerRange := fmt.Sprintf("%d:%d", rng.StartRow-1, rng.StartRow-1)
+	if rng.Sheet != "" {
+		headerRange = fmt.Sprintf("'%s'!%s", strings.ReplaceAll(rng.Sheet, "'", "''"), headerRange)
 	}
-	return imageList, exceptImageList, nil
+	resp, err := gsheet.Service.Spreadsheets.Values.Get(gsheet.SpreadsheetId, headerRange).Do()
+	if err != nil {
+		log.Error.Printf("Unable to retrieve header from sheet: %v", err)
+		return nil, err
+	}
+	header := []string{}
+	if len(resp.Values) == 0 {
+		return header, nil
+	}
+	for idx, name := range resp.Values[0] {
+		if idx >= rng.Column {
+			header = append(header, fmt.Sprint(name))
+		}
+	}
+	return header, nil
 }
 
 // Add a new sheet tab in target google sheet
@@ -113,8 +221,8 @@ func (gsheet *Gsheet) AddNewSheet(newSheetTitle string) error {
 
 }
 
-// Write to release image list info in target sheet tab
-func (gsheet *Gsheet) SetGsheet(imageList []string) error {
+// Write to release image list info in target sheet tab: [no, image, copy mode(optional)]
+func (gsheet *Gsheet) SetGsheet(imageList []string, copyModes map[string]string) error {
 
 	// Instance information set
 	spreadsheetId := gsheet.SpreadsheetId
@@ -125,6 +233,9 @@ func (gsheet *Gsheet) SetGsheet(imageList []string) error {
 	for idx, v := range imageList {
 		values[idx] = append(values[idx], idx+1)
 		values[idx] = append(values[idx], v)
+		if copyModes != nil {
+			values[idx] = append(values[idx], copyModes[v])
+		}
 	}
 
 	rb := &sheets.BatchUpdateValuesRequest{
@@ -146,33 +257,127 @@ func (gsheet *Gsheet) SetGsheet(imageList []string) error {
 	return nil
 }
 
-// Parse two image lists(export option is true or false)
-func parseImageList(resp *sheets.ValueRange) (imageList []string, exceptImageList []string) {
+// Write the sync status of each row into its status, timestamp and mirrored columns.
+// Rows of ranges without a status column are left as they are.
+func (gsheet *Gsheet) SetRowStatus(rows []Row, statuses []RowStatus) error {
+	rb := &sheets.BatchUpdateValuesRequest{
+		ValueInputOption: "USER_ENTERED",
+	}
+	for idx, row := range rows {
+		if idx >= len(statuses) || row.columns == nil || row.columns[FIELD_STATUS] == NO_COLUMN {
+			continue
+		}
+		status := statuses[idx]
+		values := map[string]string{
+			FIELD_STATUS:    status.Status,
+			FIELD_TIMESTAMP: status.Time.Format(TIMESTAMP_FORMAT),
+			FIELD_MIRRORED:  status.Digest,
+		}
+		for field, value := range values {
+			column := row.columns[field]
+			if column == NO_COLUMN {
+				continue
+			}
+			rb.Data = append(rb.Data, &sheets.ValueRange{
+				Range:  row.cell(column),
+				Values: [][]interface{}{{value}},
+			})
+		}
+	}
+	if len(rb.Data) == 0 {
+		return nil
+	}
 
-	if len(resp.Values) == 0 {
+	resp, err := gsheet.Service.Spreadsheets.Values.BatchUpdate(gsheet.SpreadsheetId, rb).Context(gsheet.Ctx).Do()
+	if err != nil {
+		log.Error.Printf("Unable to write row status to sheet: %v", err)
+		return err
+	}
+	log.Info.Printf("Row status written: %d cells", resp.TotalUpdatedCells)
+	return nil
+}
+
+// A1 notation of the row's cell in the column (relative to the range)
+func (row Row) cell(column int) string {
+	a1 := fmt.Sprintf("%s%d", columnLetter(row.column+column), row.Line)
+	if row.sheet == "" {
+		return a1
+	}
+	return fmt.Sprintf("'%s'!%s", strings.ReplaceAll(row.sheet, "'", "''"), a1)
+}
+
+// Parse image rows with the resolved column of each field
+func parseRows(readRange string, rng sheetRange, index columnIndex, flag ExportFlag, values [][]interface{}) []Row {
+	rows := []Row{}
+
+	if len(values) == 0 {
 		log.Info.Println("No data found.")
-	} else {
-		for _, row := range resp.Values {
-			data := ""
-			except := ""
-			// Print columns A and E, which correspond to indices row[0] and row[4].
-			// C와 D컬럼의 row 데이터 리스트 중 빈칸이 있으면 pass
-			if len(row) > 0 {
-				data = fmt.Sprint(row[0])
-				// 길이가 2 이상인 경우 -> [이미지명 export값] 보유
-				if len(row) > 1 {
-					except = fmt.Sprint(row[1])
-					if except == "FALSE" { // export가 false가 아닌 이미지 모두 listup
-						exceptImageList = append(exceptImageList, data)
-					} else {
-						imageList = append(imageList, data)
-					}
-				} else { // export가 없으면 true가 default, image listup
-					imageList = append(imageList, data)
-				}
+		return rows
+	}
+	startRow := rng.StartRow
+	if startRow == 0 {
+		startRow = 1
+	}
+	for idx, value := range values {
+		// 이미지 컬럼이 빈칸이면 pass
+		image := cell(value, index[FIELD_IMAGE])
+		if image == "" {
+			continue
+		}
+		row := Row{
+			Range:    readRange,
+			Index:    idx,
+			Line:     startRow + idx,
+			Digest:   cell(value, index[FIELD_DIGEST]),
+			Platform: cell(value, index[FIELD_PLATFORM]),
+			Target:   cell(value, index[FIELD_TARGET]),
+			Comment:  cell(value, index[FIELD_COMMENT]),
 
-			}
+			sheet:   rng.Sheet,
+			column:  rng.Column,
+			columns: index,
 		}
+		// export가 없으면 설정값(default true), 알 수 없는 값은 추측하지 않고 에러
+		export, exportErr := flag.Parse(cell(value, index[FIELD_EXPORT]))
+		row.Export = export
+		// digest 컬럼으로 이미지 고정
+		if row.Digest != "" && !strings.Contains(image, "@") {
+			image = image + "@" + row.Digest
+		}
+		row.Image = image
+		err := row.validate()
+		if err == nil {
+			err = exportErr
+		}
+		if err != nil {
+			row.Error = err.Error()
+			log.Warn.Printf("Invalid row %s line %d: %v", readRange, row.Line, err)
+		}
+		rows = append(rows, row)
 	}
-	return imageList, exceptImageList
+	return rows
+}
+
+// Normalize the image to its familiar form with a tag ("nginx" -> "nginx:latest") and check the target
+func (row *Row) validate() error {
+	normalized, err := registry.Normalize(row.Image)
+	if err != nil {
+		return err
+	}
+	if ref, _ := registry.ParseReference(row.Image); ref.Tag == "" && ref.Digest == "" {
+		row.Warning = "missing tag, using " + registry.DEFAULT_TAG
+	}
+	row.Image = normalized
+	if row.Target != "" {
+		ref, err := registry.ParseReference(row.Target)
+		if err != nil || ref.Tag != "" || ref.Digest != "" {
+			return fmt.Errorf("invalid target repository %q", row.Target)
+		}
+	}
+	if row.Platform != "" {
+		if _, err := skopeo.ParseCopyMode(row.Platform); err != nil {
+			return err
+		}
+	}
+	return nil
 }
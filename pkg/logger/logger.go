@@ -28,9 +28,10 @@ func GetInstance() *Logger {
 
 func New(infoHandle io.Writer, warnHandle io.Writer, errorHandle io.Writer) *Logger {
 
+	// every line is masked by the redactor before it reaches the handles
 	return &Logger{
-		log.New(infoHandle, "[INFO] ", log.Ldate|log.Ltime|log.Lshortfile),
-		log.New(warnHandle, "[WARN] ", log.Ldate|log.Ltime|log.Lshortfile),
-		log.New(errorHandle, "[ERROR] ", log.Ldate|log.Ltime|log.Lshortfile),
+		log.New(NewRedactWriter(infoHandle), "[INFO] ", log.Ldate|log.Ltime|log.Lshortfile),
+		log.New(NewRedactWriter(warnHandle), "[WARN] ", log.Ldate|log.Ltime|log.Lshortfile),
+		log.New(NewRedactWriter(errorHandle), "[ERROR] ", log.Ldate|log.Ltime|log.Lshortfile),
 	}
 }
@@ -0,0 +1,111 @@
+package logger
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	MASK = "****"
+
+	MIN_SECRET_LEN = 3 // shorter values would mask ordinary words
+)
+
+// Masks registered secrets and credential arguments before they are written
+type Redactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+type redactWriter struct {
+	w io.Writer
+}
+
+var (
+	redactor = &Redactor{}
+
+	// credential arguments of skopeo, sshpass, urls and key=value pairs
+	secretPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(--(?:src-|dest-)?creds[= ])(\S+)`),
+		regexp.MustCompile(`(sshpass\s+-p\s*)(\S+)`),
+		regexp.MustCompile(`(://[^/\s:@]+:)([^/\s@]+)(@)`),
+		regexp.MustCompile(`(?i)((?:password|passwd|secret|token)["']?\s*[=:]\s*["']?)([^\s"',]+)`),
+		regexp.MustCompile(`(?i)(Authorization:\s*(?:Basic|Bearer)\s+)(\S+)`),
+	}
+)
+
+// Register secrets (passwords, "user:pass" creds, tokens) masked in every log line and response.
+// For "user:pass" the password is registered as well, and the json-escaped form of each value
+// ("a&b" is encoded "a\u0026b") so encoded reports are masked too.
+func AddSecret(secrets ...string) {
+	redactor.mu.Lock()
+	defer redactor.mu.Unlock()
+	for _, secret := range secrets {
+		values := []string{secret}
+		if idx := strings.Index(secret, ":"); idx >= 0 {
+			values = append(values, secret[idx+1:])
+		}
+		for _, value := range values {
+			for _, variant := range []string{value, jsonEscape(value)} {
+				if len(variant) < MIN_SECRET_LEN || contains(redactor.secrets, variant) {
+					continue
+				}
+				redactor.secrets = append(redactor.secrets, variant)
+			}
+		}
+	}
+	// longest first so a cred is masked before its password part
+	sort.Slice(redactor.secrets, func(i, j int) bool {
+		return len(redactor.secrets[i]) > len(redactor.secrets[j])
+	})
+}
+
+// Mask secrets in the text
+func Redact(text string) string {
+	for _, pattern := range secretPatterns {
+		text = pattern.ReplaceAllStringFunc(text, func(match string) string {
+			groups := pattern.FindStringSubmatch(match)
+			return groups[1] + MASK + strings.Join(groups[3:], "")
+		})
+	}
+	redactor.mu.RLock()
+	defer redactor.mu.RUnlock()
+	for _, secret := range redactor.secrets {
+		text = strings.ReplaceAll(text, secret, MASK)
+	}
+	return text
+}
+
+// Writer masking secrets of everything written to w
+func NewRedactWriter(w io.Writer) io.Writer {
+	return &redactWriter{w: w}
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Value as written inside a json string by encoding/json (html characters escaped)
+func jsonEscape(value string) string {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	return string(b[1 : len(b)-1])
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
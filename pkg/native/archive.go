@@ -0,0 +1,290 @@
+package native
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	client "github.com/gsheet-exporter/internal/registry"
+)
+
+const (
+	OCI_LAYOUT_VERSION  = "1.0.0"
+	ANNOTATION_REF_NAME = "org.opencontainers.image.ref.name"
+)
+
+// Mirrored image written into an archive
+type ArchiveImage struct {
+	Image string // sheet image, reported back
+	Name  string // mirror repository
+	Ref   string // tag or digest in the mirror
+}
+
+// Images archived and skipped, blobs shared by several images are counted once
+type ArchiveStats struct {
+	Images  []string          `json:"images"`
+	Skipped map[string]string `json:"skipped,omitempty"` // image -> reason
+	Blobs   int               `json:"blobs"`
+	Size    int64             `json:"size"` // bytes of the blobs
+}
+
+// index.json of the image layout
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// manifest.json entry read by docker load
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// Tarball of an OCI image layout (oci-layout, index.json, blobs/sha256/...) with a docker save manifest.json,
+// loadable by skopeo (oci-archive:), containerd and docker load
+type archiveWriter struct {
+	native *Native
+	tar    *tar.Writer
+	now    time.Time
+
+	dirs    map[string]bool
+	written map[string]bool // blob digests already in the archive
+	index   ociIndex
+	docker  []dockerManifest
+	stats   ArchiveStats
+}
+
+// Write the images as they are stored in the mirror, each blob only once.
+// Images missing from the mirror or stored as schema1 are skipped, the archive holds the rest.
+func (native *Native) WriteArchive(w io.Writer, images []ArchiveImage) (*ArchiveStats, error) {
+	a := &archiveWriter{
+		native:  native,
+		tar:     tar.NewWriter(w),
+		now:     time.Now(),
+		dirs:    map[string]bool{},
+		written: map[string]bool{},
+		index:   ociIndex{SchemaVersion: 2, MediaType: client.MEDIA_TYPE_OCI_INDEX, Manifests: []ociDescriptor{}},
+		docker:  []dockerManifest{},
+		stats:   ArchiveStats{Images: []string{}, Skipped: map[string]string{}},
+	}
+	for _, image := range images {
+		reason, err := a.addImage(image)
+		if err != nil {
+			return &a.stats, fmt.Errorf("%s: %v", image.Image, err)
+		}
+		if reason != "" {
+			log.Warn.Printf("%s is not archived: %s", image.Image, reason)
+			a.stats.Skipped[image.Image] = reason
+			continue
+		}
+		a.stats.Images = append(a.stats.Images, image.Image)
+	}
+
+	if err := a.writeJSON("oci-layout", map[string]string{"imageLayoutVersion": OCI_LAYOUT_VERSION}); err != nil {
+		return &a.stats, err
+	}
+	if err := a.writeJSON("index.json", a.index); err != nil {
+		return &a.stats, err
+	}
+	if err := a.writeJSON("manifest.json", a.docker); err != nil {
+		return &a.stats, err
+	}
+	return &a.stats, a.tar.Close()
+}
+
+// Add the image manifest (every platform of a list) and its blobs, the skip reason is returned
+func (a *archiveWriter) addImage(image ArchiveImage) (string, error) {
+	dest := a.native.dest
+	manifest, found, err := dest.GetManifest(image.Name, image.Ref)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return fmt.Sprintf("manifest unknown: %s/%s", a.native.CopyTo, reference(image.Name, image.Ref)), nil
+	}
+	if isSchema1(manifest) {
+		return "schema1 manifest has no OCI layout", nil
+	}
+
+	// docker load takes one platform, the host's one of a list
+	loaded := manifest
+	if manifest.IsList() {
+		children, err := manifest.Children()
+		if err != nil {
+			return "", err
+		}
+		want := systemPlatform()
+		loaded = nil
+		for _, child := range children {
+			childManifest, found, err := dest.GetManifest(image.Name, child.Digest)
+			if err != nil {
+				return "", err
+			}
+			if !found {
+				return fmt.Sprintf("manifest unknown: %s/%s@%s", a.native.CopyTo, image.Name, child.Digest), nil
+			}
+			if err := a.addManifest(image.Name, childManifest); err != nil {
+				return "", err
+			}
+			if platform := child.Platform; loaded == nil && platform != nil && platform.OS == want.OS && platform.Architecture == want.Architecture {
+				loaded = childManifest
+			}
+		}
+	}
+	if err := a.addManifest(image.Name, manifest); err != nil {
+		return "", err
+	}
+
+	descriptor := ociDescriptor{MediaType: manifest.Type(), Digest: manifest.Digest, Size: int64(len(manifest.Body))}
+	if !strings.Contains(image.Ref, ":") {
+		descriptor.Annotations = map[string]string{ANNOTATION_REF_NAME: reference(image.Name, image.Ref)}
+	}
+	a.index.Manifests = append(a.index.Manifests, descriptor)
+
+	if loaded != nil {
+		entry, err := dockerEntry(loaded)
+		if err != nil {
+			return "", err
+		}
+		if !strings.Contains(image.Ref, ":") {
+			entry.RepoTags = []string{reference(image.Name, image.Ref)}
+		}
+		a.docker = append(a.docker, *entry)
+	} else {
+		log.Warn.Printf("%s has no %s/%s image, docker load cannot read it", image.Image, systemPlatform().OS, systemPlatform().Architecture)
+	}
+	return "", nil
+}
+
+// Write the blobs of an image manifest, then the manifest itself
+func (a *archiveWriter) addManifest(name string, manifest *client.Manifest) error {
+	if !manifest.IsList() {
+		blobs, err := manifest.Blobs()
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			if err := a.addBlob(name, blob); err != nil {
+				return err
+			}
+		}
+	}
+	if a.written[manifest.Digest] {
+		return nil
+	}
+	if err := a.writeFile(blobPath(manifest.Digest), int64(len(manifest.Body)), bytes.NewReader(manifest.Body), manifest.Digest); err != nil {
+		return err
+	}
+	a.written[manifest.Digest] = true
+	return nil
+}
+
+// Stream the blob from the mirror unless another image already wrote it
+func (a *archiveWriter) addBlob(name string, blob client.Descriptor) error {
+	if a.written[blob.Digest] {
+		return nil
+	}
+	body, size, err := a.native.dest.GetBlob(name, blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if blob.Size > 0 {
+		size = blob.Size
+	}
+	if size < 0 {
+		return fmt.Errorf("unknown size of blob %s@%s", name, blob.Digest)
+	}
+	if err := a.writeFile(blobPath(blob.Digest), size, body, blob.Digest); err != nil {
+		return err
+	}
+	a.written[blob.Digest] = true
+	a.stats.Blobs++
+	a.stats.Size += size
+	return nil
+}
+
+func (a *archiveWriter) writeJSON(name string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return a.writeFile(name, int64(len(body)), bytes.NewReader(body), "")
+}
+
+// Write a tar member (and its parent directories), the content is checked against the digest when set
+func (a *archiveWriter) writeFile(name string, size int64, r io.Reader, digest string) error {
+	if err := a.writeDirs(path.Dir(name)); err != nil {
+		return err
+	}
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: a.now}
+	if err := a.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	written, err := io.Copy(a.tar, io.TeeReader(r, hash))
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("%s: read %d bytes, expected %d", name, written, size)
+	}
+	if strings.HasPrefix(digest, "sha256:") && "sha256:"+hex.EncodeToString(hash.Sum(nil)) != digest {
+		return fmt.Errorf("%s: content does not match its digest", name)
+	}
+	return nil
+}
+
+// Directory members, parents before children
+func (a *archiveWriter) writeDirs(dir string) error {
+	if dir == "." || a.dirs[dir] {
+		return nil
+	}
+	if err := a.writeDirs(path.Dir(dir)); err != nil {
+		return err
+	}
+	a.dirs[dir] = true
+	return a.tar.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: a.now})
+}
+
+// docker load entry of an image manifest, layers keep the manifest order
+func dockerEntry(manifest *client.Manifest) (*dockerManifest, error) {
+	body := schema2Manifest{}
+	if err := json.Unmarshal(manifest.Body, &body); err != nil {
+		return nil, err
+	}
+	entry := &dockerManifest{Config: blobPath(body.Config.Digest), RepoTags: []string{}, Layers: []string{}}
+	for _, layer := range body.Layers {
+		entry.Layers = append(entry.Layers, blobPath(layer.Digest))
+	}
+	return entry, nil
+}
+
+// "sha256:abc" -> "blobs/sha256/abc"
+func blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// "name:tag" or "name@sha256:..."
+func reference(name, ref string) string {
+	if strings.Contains(ref, ":") {
+		return name + "@" + ref
+	}
+	return name + ":" + ref
+}
@@ -0,0 +1,151 @@
+package native
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	client "github.com/gsheet-exporter/internal/registry"
+)
+
+// Regular files of the tar by name
+func readTar(t *testing.T, data []byte) map[string][]byte {
+	files := map[string][]byte{}
+	reader := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if _, ok := files[header.Name]; ok {
+			t.Errorf("%s written twice", header.Name)
+		}
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = content
+	}
+}
+
+func TestWriteArchive(t *testing.T) {
+	mirror := newTestRegistry(t)
+	shared := []byte("shared base layer")
+	appDigest := mirror.addImage("app", "1", "linux/amd64", shared, []byte("app layer"))
+	toolDigest := mirror.addImage("tool", "1", "linux/amd64", shared, []byte("tool layer"))
+	listDigest, children := mirror.addList("multi", "1", "linux/amd64", "linux/arm64")
+	mirror.addImage("left-out", "1", "linux/amd64", []byte("left out layer"))
+
+	images := []ArchiveImage{
+		{Image: "app:1", Name: "app", Ref: "1"},
+		{Image: "tool:1", Name: "tool", Ref: "1"},
+		{Image: "multi:1", Name: "multi", Ref: "1"},
+		// the same manifest again, pinned by digest
+		{Image: "app@" + appDigest, Name: "app", Ref: appDigest},
+		{Image: "gone:1", Name: "gone", Ref: "1"},
+	}
+	out := &bytes.Buffer{}
+	stats, err := newTestNative(t, mirror).WriteArchive(out, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(stats.Images, ",") != "app:1,tool:1,multi:1,app@"+appDigest {
+		t.Errorf("archived images %v", stats.Images)
+	}
+	if reason := stats.Skipped["gone:1"]; !strings.Contains(reason, "manifest unknown") || len(stats.Skipped) != 1 {
+		t.Errorf("skipped %v", stats.Skipped)
+	}
+
+	files := readTar(t, out.Bytes())
+	if string(files["oci-layout"]) != `{"imageLayoutVersion":"1.0.0"}` {
+		t.Errorf("oci-layout %s", files["oci-layout"])
+	}
+
+	// every blob of the archived images once, nothing of the other images
+	amd64Config, _ := json.Marshal(map[string]string{"os": "linux", "architecture": "amd64"})
+	arm64Config, _ := json.Marshal(map[string]string{"os": "linux", "architecture": "arm64"})
+	wantBlobs := []string{
+		appDigest, toolDigest, listDigest, children["linux/amd64"], children["linux/arm64"],
+		digestOf(amd64Config), digestOf(arm64Config),
+		digestOf(shared), digestOf([]byte("app layer")), digestOf([]byte("tool layer")),
+		digestOf([]byte("linux/amd64 layer")), digestOf([]byte("linux/arm64 layer")),
+	}
+	for i, digest := range wantBlobs {
+		wantBlobs[i] = blobPath(digest)
+	}
+	sort.Strings(wantBlobs)
+	blobs := []string{}
+	for name, content := range files {
+		if !strings.HasPrefix(name, "blobs/") {
+			continue
+		}
+		blobs = append(blobs, name)
+		if "blobs/"+strings.Replace(digestOf(content), ":", "/", 1) != name {
+			t.Errorf("%s does not match its content", name)
+		}
+	}
+	sort.Strings(blobs)
+	if strings.Join(blobs, "\n") != strings.Join(wantBlobs, "\n") {
+		t.Errorf("blobs:\n%s\nwant:\n%s", strings.Join(blobs, "\n"), strings.Join(wantBlobs, "\n"))
+	}
+	// layers and configs, manifests are not counted
+	if stats.Blobs != 7 {
+		t.Errorf("%d blobs counted, want 7", stats.Blobs)
+	}
+
+	index := ociIndex{}
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		t.Fatal(err)
+	}
+	if index.SchemaVersion != 2 || index.MediaType != client.MEDIA_TYPE_OCI_INDEX || len(index.Manifests) != 4 {
+		t.Fatalf("index.json %s", files["index.json"])
+	}
+	want := []struct {
+		digest, mediaType, name string
+	}{
+		{appDigest, client.MEDIA_TYPE_DOCKER_V2, "app:1"},
+		{toolDigest, client.MEDIA_TYPE_DOCKER_V2, "tool:1"},
+		{listDigest, client.MEDIA_TYPE_DOCKER_LIST, "multi:1"},
+		// no name for an image pinned by digest
+		{appDigest, client.MEDIA_TYPE_DOCKER_V2, ""},
+	}
+	for i, descriptor := range index.Manifests {
+		if descriptor.Digest != want[i].digest || descriptor.MediaType != want[i].mediaType || descriptor.Annotations[ANNOTATION_REF_NAME] != want[i].name {
+			t.Errorf("index manifest %d: %+v, want %+v", i, descriptor, want[i])
+		}
+		if content, ok := files[blobPath(descriptor.Digest)]; !ok || int64(len(content)) != descriptor.Size {
+			t.Errorf("index manifest %d: size %d, blob of %d bytes", i, descriptor.Size, len(content))
+		}
+	}
+
+	docker := []dockerManifest{}
+	if err := json.Unmarshal(files["manifest.json"], &docker); err != nil {
+		t.Fatal(err)
+	}
+	if len(docker) < 3 {
+		t.Fatalf("manifest.json %s", files["manifest.json"])
+	}
+	app := docker[0]
+	if strings.Join(app.RepoTags, ",") != "app:1" || app.Config != blobPath(digestOf(amd64Config)) ||
+		strings.Join(app.Layers, ",") != blobPath(digestOf(shared))+","+blobPath(digestOf([]byte("app layer"))) {
+		t.Errorf("docker load entry of app:1 %+v", app)
+	}
+	for _, entry := range docker {
+		for _, member := range append([]string{entry.Config}, entry.Layers...) {
+			if _, ok := files[member]; !ok {
+				t.Errorf("docker load entry %v refers to the missing %s", entry.RepoTags, member)
+			}
+		}
+	}
+}
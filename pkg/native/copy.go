@@ -0,0 +1,158 @@
+package native
+
+import (
+	"fmt"
+	"strings"
+
+	client "github.com/gsheet-exporter/internal/registry"
+	"github.com/gsheet-exporter/pkg/registry"
+	"github.com/gsheet-exporter/pkg/skopeo"
+)
+
+// One image copied from a source repository into a mirror repository
+type copyJob struct {
+	native   *Native
+	source   *client.Client
+	srcName  string
+	destName string
+
+	convertSchema1 bool // push legacy schema1 manifests as schema2
+
+	// blob counters for the output
+	uploaded, mounted, existing int
+	converted                   bool
+}
+
+// Copy every platform of the list, then the list itself
+func (c *copyJob) copyList(list *client.Manifest, destRef string) error {
+	children, err := list.Children()
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		manifest, found, err := c.source.GetManifest(c.srcName, child.Digest)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("manifest unknown: %s@%s", c.srcName, child.Digest)
+		}
+		if err := c.copyImage(manifest, child.Digest); err != nil {
+			return err
+		}
+	}
+	_, err = c.native.dest.PutManifest(c.destName, destRef, list.MediaType, list.Body)
+	return err
+}
+
+// Manifest of the platform selected by the mode ("system" or "os/arch[/variant]")
+func (c *copyJob) selectPlatform(list *client.Manifest, mode string) (*client.Manifest, error) {
+	want := systemPlatform()
+	if mode != skopeo.COPY_SYSTEM {
+		parts := strings.Split(mode, "/")
+		want = client.Platform{OS: parts[0], Architecture: parts[1]}
+		if len(parts) > 2 {
+			want.Variant = parts[2]
+		}
+	}
+	children, err := list.Children()
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		platform := child.Platform
+		if platform == nil || platform.OS != want.OS || platform.Architecture != want.Architecture {
+			continue
+		}
+		if want.Variant != "" && platform.Variant != want.Variant {
+			continue
+		}
+		manifest, found, err := c.source.GetManifest(c.srcName, child.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("manifest unknown: %s@%s", c.srcName, child.Digest)
+		}
+		return manifest, nil
+	}
+	return nil, fmt.Errorf("no image for platform %s/%s in %s", want.OS, want.Architecture, c.srcName)
+}
+
+// Copy the blobs of an image manifest, then push the manifest
+func (c *copyJob) copyImage(manifest *client.Manifest, destRef string) error {
+	blobs, err := manifest.Blobs()
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if err := c.copyBlob(blob.Digest); err != nil {
+			return err
+		}
+	}
+	if c.convertSchema1 && isSchema1(manifest) {
+		converted, err := c.toSchema2(manifest)
+		if err != nil {
+			// registries still accepting schema1 keep the image usable
+			log.Warn.Printf("Cannot convert schema1 manifest of %s, pushing it as is: %v", c.srcName, err)
+		} else {
+			manifest = converted
+			c.converted = true
+		}
+	}
+	_, err = c.native.dest.PutManifest(c.destName, destRef, manifest.MediaType, manifest.Body)
+	return err
+}
+
+// Skip blobs the mirror repository holds, mount blobs of other mirror repositories, upload the rest
+func (c *copyJob) copyBlob(digest string) error {
+	dest := c.native.dest
+	exists, err := dest.BlobExists(c.destName, digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		c.existing++
+		c.native.stored(digest, c.destName)
+		return nil
+	}
+
+	location := ""
+	if from := c.native.mountFrom(digest, c.destName); from != "" {
+		mounted, session, err := dest.MountBlob(c.destName, digest, from)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			c.mounted++
+			c.native.stored(digest, c.destName)
+			return nil
+		}
+		location = session
+	}
+
+	body, _, err := c.source.GetBlob(c.srcName, digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := dest.UploadBlob(c.destName, digest, body, location, c.native.ChunkSize); err != nil {
+		return err
+	}
+	c.uploaded++
+	c.native.stored(digest, c.destName)
+	return nil
+}
+
+func (c *copyJob) output(ref registry.Reference, destRef, mode string) string {
+	sep := ":"
+	if strings.Contains(destRef, ":") {
+		sep = "@"
+	}
+	output := fmt.Sprintf("Copied %s to %s/%s%s%s (%s): %d blobs uploaded, %d mounted, %d existing",
+		ref, c.native.CopyTo, c.destName, sep, destRef, mode, c.uploaded, c.mounted, c.existing)
+	if c.converted {
+		output += ", schema1 converted to schema2"
+	}
+	return output
+}
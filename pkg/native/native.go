@@ -0,0 +1,267 @@
+package native
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	client "github.com/gsheet-exporter/internal/registry"
+	"github.com/gsheet-exporter/pkg/logger"
+	"github.com/gsheet-exporter/pkg/registry"
+	"github.com/gsheet-exporter/pkg/skopeo"
+)
+
+// Copy, delete and inspect images with the registry v2 API, without the skopeo binary
+type Native struct {
+	CopyTo    string
+	CopyMode  string // manifest list handling when the image has no mode of its own
+	ChunkSize int    // bytes of one blob upload request
+
+	dest       *client.Client
+	sourceCred func(image string) string
+
+	mu      sync.Mutex
+	sources map[string]*client.Client // source registry host & cred -> client
+	mounts  map[string]string         // blob digest -> mirror repository holding it
+}
+
+// Connection options of the mirror registry
+type Options struct {
+	Cred       string // "user:pass" of the mirror
+	CAFile     string
+	Insecure   bool
+	SourceCred func(image string) string // "user:pass" of the image's source registry, empty for anonymous
+}
+
+var (
+	log = logger.GetInstance()
+)
+
+func New(copyTo string, opts Options) (*Native, error) {
+	clientOpts := client.Options{
+		CAFile:   opts.CAFile,
+		Insecure: opts.Insecure,
+	}
+	if opts.Cred != "" {
+		username, password, err := splitCred(opts.Cred)
+		if err != nil {
+			return nil, err
+		}
+		clientOpts.Username, clientOpts.Password = username, password
+	}
+	dest, err := client.NewClient(copyTo, clientOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &Native{
+		CopyTo:    copyTo,
+		ChunkSize: client.DEFAULT_CHUNK_SIZE,
+
+		dest:       dest,
+		sourceCred: opts.SourceCred,
+		sources:    map[string]*client.Client{},
+		mounts:     map[string]string{},
+	}, nil
+}
+
+// Copy the image into the mirror under its familiar path (docker.io/library/nginx -> {mirror}/nginx) or the target.
+// opts.Mode selects the platforms of a manifest list, empty uses the global CopyMode.
+// The mode actually applied is returned, errors are returned as output for the retry policy.
+func (native *Native) Copy(image string, opts skopeo.CopyOptions) (string, string, error) {
+	mode := opts.Mode
+	if mode == "" {
+		mode = native.CopyMode
+	}
+	mode = skopeo.AppliedCopyMode(mode)
+
+	output, mode, err := native.copy(image, mode, opts.Target, false)
+	if err != nil {
+		log.Error.Printf("Cannot copy %s: %v", image, err)
+		return err.Error(), mode, err
+	}
+	log.Info.Println(output)
+	return output, mode, nil
+}
+
+// Copy a legacy image of the "unsupported" sheet without a docker daemon,
+// schema1 manifests are converted to schema2 where possible
+func (native *Native) PushV1(image string) (string, error) {
+	output, _, err := native.copy(image, skopeo.COPY_SYSTEM, "", true)
+	if err != nil {
+		log.Error.Printf("Cannot push %s: %v", image, err)
+		return err.Error(), err
+	}
+	log.Info.Println(output)
+	return output, nil
+}
+
+func (native *Native) copy(image, mode, target string, convertSchema1 bool) (string, string, error) {
+	ref, err := registry.ParseNormalized(image)
+	if err != nil {
+		return "", mode, err
+	}
+	source, err := native.source(ref)
+	if err != nil {
+		return "", mode, err
+	}
+	// pull the pinned digest, push under the tag when there is one
+	srcRef, destRef := ref.Tag, ref.Tag
+	if ref.Digest != "" {
+		srcRef = ref.Digest
+	}
+	if destRef == "" {
+		destRef = ref.Digest
+	}
+
+	manifest, found, err := source.GetManifest(ref.Path, srcRef)
+	if err != nil {
+		return "", mode, err
+	}
+	if !found {
+		return "", mode, fmt.Errorf("manifest unknown: %s", ref)
+	}
+
+	c := &copyJob{native: native, source: source, srcName: ref.Path, destName: ref.MirrorName(target), convertSchema1: convertSchema1}
+	if manifest.IsList() {
+		// a list pushed by its digest cannot be replaced by one of its platforms
+		if ref.Tag == "" && mode != skopeo.COPY_ALL {
+			log.Warn.Printf("%s is pinned to a manifest list, copying all platforms", image)
+			mode = skopeo.COPY_ALL
+		}
+		if mode == skopeo.COPY_ALL {
+			if err := c.copyList(manifest, destRef); err != nil {
+				return "", mode, err
+			}
+			return c.output(ref, destRef, mode), mode, nil
+		}
+		if manifest, err = c.selectPlatform(manifest, mode); err != nil {
+			return "", mode, err
+		}
+	}
+	if err := c.copyImage(manifest, destRef); err != nil {
+		return "", mode, err
+	}
+	return c.output(ref, destRef, mode), mode, nil
+}
+
+// Delete the mirrored "repository:tag" by its manifest digest
+func (native *Native) Delete(image string) (string, error) {
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return err.Error(), err
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = registry.DEFAULT_TAG
+	}
+	target := ref.Digest
+	if target == "" {
+		digest, found, err := native.dest.ManifestDigest(ref.Name(), ref.Tag)
+		if err != nil {
+			return err.Error(), err
+		}
+		if !found {
+			log.Info.Printf("[%s] Not Exists in Registry", image)
+			return "", nil
+		}
+		target = digest
+	}
+
+	found, err := native.dest.DeleteManifest(ref.Name(), target)
+	if err != nil {
+		log.Error.Print(err)
+		return err.Error(), err
+	}
+	if !found {
+		log.Info.Printf("[%s] Not Exists in Registry", image)
+		return "", nil
+	}
+	output := fmt.Sprintf("Deleted %s/%s@%s", native.CopyTo, ref.Name(), target)
+	log.Info.Println(output)
+	return output, nil
+}
+
+// Check the image exists in its source registry
+func (native *Native) Inspect(image string) error {
+	ref, err := registry.ParseNormalized(image)
+	if err != nil {
+		return err
+	}
+	source, err := native.source(ref)
+	if err != nil {
+		return err
+	}
+	srcRef := ref.Tag
+	if ref.Digest != "" {
+		srcRef = ref.Digest
+	}
+	_, found, err := source.ManifestDigest(ref.Path, srcRef)
+	if err != nil {
+		log.Error.Print(err)
+		return err
+	}
+	if !found {
+		return fmt.Errorf("manifest unknown: %s", ref)
+	}
+	return nil
+}
+
+// Client of the image's source registry, shared by the images of the same host
+func (native *Native) source(ref registry.Reference) (*client.Client, error) {
+	host := ref.RegistryHost()
+	cred := ""
+	if native.sourceCred != nil {
+		cred = native.sourceCred(ref.String())
+	}
+
+	native.mu.Lock()
+	defer native.mu.Unlock()
+	key := host + " " + cred
+	if source, ok := native.sources[key]; ok {
+		return source, nil
+	}
+	opts := client.Options{}
+	if cred != "" {
+		username, password, err := splitCred(cred)
+		if err != nil {
+			return nil, fmt.Errorf("cred of %s: %v", host, err)
+		}
+		opts.Username, opts.Password = username, password
+	}
+	source, err := client.NewClient(host, opts)
+	if err != nil {
+		return nil, err
+	}
+	native.sources[key] = source
+	return source, nil
+}
+
+// Mirror repository already holding the blob, empty when unknown
+func (native *Native) mountFrom(digest, destName string) string {
+	native.mu.Lock()
+	defer native.mu.Unlock()
+	if from := native.mounts[digest]; from != destName {
+		return from
+	}
+	return ""
+}
+
+func (native *Native) stored(digest, destName string) {
+	native.mu.Lock()
+	defer native.mu.Unlock()
+	native.mounts[digest] = destName
+}
+
+func splitCred(cred string) (string, string, error) {
+	userPass := strings.SplitN(cred, ":", 2)
+	if len(userPass) != 2 {
+		return "", "", errors.New("cred must be 'user:pass'")
+	}
+	return userPass[0], userPass[1], nil
+}
+
+// Platform of the host, the one skopeo copies by default
+func systemPlatform() client.Platform {
+	return client.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
@@ -0,0 +1,398 @@
+package native
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	client "github.com/gsheet-exporter/internal/registry"
+	"github.com/gsheet-exporter/pkg/skopeo"
+)
+
+// Source registries are reached over https without a CA option, every httptest server
+// shares one certificate which is trusted through SSL_CERT_FILE before any tls use.
+func TestMain(m *testing.M) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	dir, err := ioutil.TempDir("", "native-test")
+	if err != nil {
+		panic(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(certFile, cert, 0600); err != nil {
+		panic(err)
+	}
+	server.Close()
+	os.Setenv("SSL_CERT_FILE", certFile)
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type testManifest struct {
+	mediaType string
+	body      []byte
+}
+
+// In-process registry v2 keeping blobs and manifests in memory
+type testRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[string]map[string][]byte       // repository -> digest -> content
+	manifests map[string]map[string]testManifest // repository -> tag or digest -> manifest
+	uploads   map[string]*bytes.Buffer           // session -> received content
+	sessions  int
+
+	mounts, patches, deletes int
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		blobs:     map[string]map[string][]byte{},
+		manifests: map[string]map[string]testManifest{},
+		uploads:   map[string]*bytes.Buffer{},
+	}
+	r.Server = httptest.NewTLSServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// "127.0.0.1:port", the host part of the image references
+func (r *testRegistry) Host() string {
+	return strings.TrimPrefix(r.URL, "https://")
+}
+
+func digestOf(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+func (r *testRegistry) addBlob(repo string, content []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.blobs[repo] == nil {
+		r.blobs[repo] = map[string][]byte{}
+	}
+	digest := digestOf(content)
+	r.blobs[repo][digest] = content
+	return digest
+}
+
+func (r *testRegistry) addManifest(repo, tag, mediaType string, body []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.putManifest(repo, tag, mediaType, body)
+}
+
+func (r *testRegistry) putManifest(repo, ref, mediaType string, body []byte) string {
+	if r.manifests[repo] == nil {
+		r.manifests[repo] = map[string]testManifest{}
+	}
+	digest := digestOf(body)
+	if ref != "" {
+		r.manifests[repo][ref] = testManifest{mediaType: mediaType, body: body}
+	}
+	r.manifests[repo][digest] = testManifest{mediaType: mediaType, body: body}
+	return digest
+}
+
+// Image manifest of the platform with its config and layers, the digest is returned
+func (r *testRegistry) addImage(repo, tag, platform string, layers ...[]byte) string {
+	parts := strings.Split(platform, "/")
+	config, _ := json.Marshal(map[string]string{"os": parts[0], "architecture": parts[1]})
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     client.MEDIA_TYPE_DOCKER_V2,
+		"config":        client.Descriptor{MediaType: "application/vnd.docker.container.image.v1+json", Digest: r.addBlob(repo, config), Size: int64(len(config))},
+	}
+	descriptors := []client.Descriptor{}
+	for _, layer := range layers {
+		descriptors = append(descriptors, client.Descriptor{MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", Digest: r.addBlob(repo, layer), Size: int64(len(layer))})
+	}
+	manifest["layers"] = descriptors
+	body, _ := json.Marshal(manifest)
+	return r.addManifest(repo, tag, client.MEDIA_TYPE_DOCKER_V2, body)
+}
+
+func (r *testRegistry) manifest(repo, ref string) (testManifest, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	manifest, ok := r.manifests[repo][ref]
+	return manifest, ok
+}
+
+func (r *testRegistry) blob(repo, digest string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	content, ok := r.blobs[repo][digest]
+	return content, ok
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == "" {
+		return
+	}
+	switch {
+	case strings.Contains(path, "/blobs/uploads/"):
+		idx := strings.Index(path, "/blobs/uploads/")
+		r.serveUpload(w, req, path[:idx], path[idx+len("/blobs/uploads/"):])
+	case strings.Contains(path, "/blobs/"):
+		idx := strings.Index(path, "/blobs/")
+		content, ok := r.blobs[path[:idx]][path[idx+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if req.Method == http.MethodGet {
+			w.Write(content)
+		}
+	case strings.Contains(path, "/manifests/"):
+		idx := strings.Index(path, "/manifests/")
+		r.serveManifest(w, req, path[:idx], path[idx+len("/manifests/"):])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repo, ref string) {
+	switch req.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(req.Body)
+		w.Header().Set(client.DIGEST_HEADER, r.putManifest(repo, ref, req.Header.Get("Content-Type"), body))
+		w.WriteHeader(http.StatusCreated)
+		return
+	case http.MethodDelete:
+		manifest, ok := r.manifests[repo][ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// the tags of the manifest go with it
+		for key, stored := range r.manifests[repo] {
+			if bytes.Equal(stored.body, manifest.body) {
+				delete(r.manifests[repo], key)
+			}
+		}
+		r.deletes++
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	manifest, ok := r.manifests[repo][ref]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", manifest.mediaType)
+	w.Header().Set(client.DIGEST_HEADER, digestOf(manifest.body))
+	if req.Method == http.MethodGet {
+		w.Write(manifest.body)
+	}
+}
+
+func (r *testRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repo, session string) {
+	switch req.Method {
+	case http.MethodPost:
+		query := req.URL.Query()
+		if from := query.Get("from"); from != "" {
+			if content, ok := r.blobs[from][query.Get("mount")]; ok {
+				if r.blobs[repo] == nil {
+					r.blobs[repo] = map[string][]byte{}
+				}
+				r.blobs[repo][query.Get("mount")] = content
+				r.mounts++
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		r.sessions++
+		session = fmt.Sprint(r.sessions)
+		r.uploads[session] = &bytes.Buffer{}
+	case http.MethodPatch:
+		io.Copy(r.uploads[session], req.Body)
+		r.patches++
+	case http.MethodPut:
+		content := r.uploads[session].Bytes()
+		if digestOf(content) != req.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.blobs[repo] == nil {
+			r.blobs[repo] = map[string][]byte{}
+		}
+		r.blobs[repo][digestOf(content)] = content
+		delete(r.uploads, session)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, session))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func newTestNative(t *testing.T, mirror *testRegistry) *Native {
+	native, err := New(mirror.Host(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return native
+}
+
+func TestCopyUploadsBlobsInChunks(t *testing.T) {
+	source, mirror := newTestRegistry(t), newTestRegistry(t)
+	digest := source.addImage("org/app", "1", "linux/amd64", []byte("first layer content"), []byte("second layer content"))
+	native := newTestNative(t, mirror)
+	native.ChunkSize = 8
+
+	output, mode, err := native.Copy(source.Host()+"/org/app:1", skopeo.CopyOptions{Target: "app"})
+	if err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if mode != skopeo.COPY_SYSTEM || !strings.Contains(output, "3 blobs uploaded") {
+		t.Errorf("unexpected output %q (%s)", output, mode)
+	}
+	manifest, ok := mirror.manifest("app", "1")
+	if !ok || digestOf(manifest.body) != digest {
+		t.Fatalf("mirror has no app:1 with digest %s", digest)
+	}
+	for _, layer := range []string{"first layer content", "second layer content"} {
+		if content, ok := mirror.blob("app", digestOf([]byte(layer))); !ok || string(content) != layer {
+			t.Errorf("mirror blob %q = %q", layer, content)
+		}
+	}
+	// 20 bytes layers in 8 bytes chunks
+	if mirror.patches <= 3 {
+		t.Errorf("blobs were sent in %d requests, not in chunks", mirror.patches)
+	}
+}
+
+func TestCopyMountsBlobsOfOtherRepositories(t *testing.T) {
+	source, mirror := newTestRegistry(t), newTestRegistry(t)
+	shared := []byte("shared base layer")
+	source.addImage("org/app", "1", "linux/amd64", shared, []byte("app layer"))
+	source.addImage("org/tool", "1", "linux/amd64", shared, []byte("tool layer"))
+	native := newTestNative(t, mirror)
+
+	if _, _, err := native.Copy(source.Host()+"/org/app:1", skopeo.CopyOptions{Target: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	output, _, err := native.Copy(source.Host()+"/org/tool:1", skopeo.CopyOptions{Target: "tool"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the config is the same too (same platform)
+	if mirror.mounts != 2 || !strings.Contains(output, "2 mounted") {
+		t.Errorf("%d blobs mounted: %s", mirror.mounts, output)
+	}
+	if _, ok := mirror.blob("tool", digestOf(shared)); !ok {
+		t.Error("shared layer is missing in the tool repository")
+	}
+}
+
+func (r *testRegistry) addList(repo, tag string, platforms ...string) (string, map[string]string) {
+	children := map[string]string{}
+	descriptors := []client.Descriptor{}
+	for _, platform := range platforms {
+		digest := r.addImage(repo, "", platform, []byte(platform+" layer"))
+		children[platform] = digest
+		parts := strings.Split(platform, "/")
+		descriptors = append(descriptors, client.Descriptor{
+			MediaType: client.MEDIA_TYPE_DOCKER_V2,
+			Digest:    digest,
+			Platform:  &client.Platform{OS: parts[0], Architecture: parts[1]},
+		})
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     client.MEDIA_TYPE_DOCKER_LIST,
+		"manifests":     descriptors,
+	})
+	return r.addManifest(repo, tag, client.MEDIA_TYPE_DOCKER_LIST, body), children
+}
+
+func TestCopyList(t *testing.T) {
+	source := newTestRegistry(t)
+	listDigest, children := source.addList("org/app", "1", "linux/amd64", "linux/arm64")
+
+	t.Run("all", func(t *testing.T) {
+		mirror := newTestRegistry(t)
+		_, mode, err := newTestNative(t, mirror).Copy(source.Host()+"/org/app:1", skopeo.CopyOptions{Mode: skopeo.COPY_ALL, Target: "app"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		list, ok := mirror.manifest("app", "1")
+		if mode != skopeo.COPY_ALL || !ok || digestOf(list.body) != listDigest {
+			t.Fatalf("mirror has no list %s (%s)", listDigest, mode)
+		}
+		for platform, digest := range children {
+			if _, ok := mirror.manifest("app", digest); !ok {
+				t.Errorf("%s image %s is missing", platform, digest)
+			}
+		}
+	})
+
+	t.Run("platform", func(t *testing.T) {
+		mirror := newTestRegistry(t)
+		if _, _, err := newTestNative(t, mirror).Copy(source.Host()+"/org/app:1", skopeo.CopyOptions{Mode: "linux/arm64", Target: "app"}); err != nil {
+			t.Fatal(err)
+		}
+		manifest, ok := mirror.manifest("app", "1")
+		if !ok || digestOf(manifest.body) != children["linux/arm64"] {
+			t.Fatalf("mirror app:1 is not the linux/arm64 image %s", children["linux/arm64"])
+		}
+		if _, ok := mirror.manifest("app", children["linux/amd64"]); ok {
+			t.Error("linux/amd64 image was copied")
+		}
+	})
+
+	t.Run("missing platform", func(t *testing.T) {
+		mirror := newTestRegistry(t)
+		if _, _, err := newTestNative(t, mirror).Copy(source.Host()+"/org/app:1", skopeo.CopyOptions{Mode: "linux/s390x", Target: "app"}); err == nil {
+			t.Fatal("copy of a platform missing from the list succeeded")
+		}
+		if _, ok := mirror.manifest("app", "1"); ok {
+			t.Error("a manifest was pushed")
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+	source, mirror := newTestRegistry(t), newTestRegistry(t)
+	source.addImage("org/app", "1", "linux/amd64", []byte("layer"))
+	native := newTestNative(t, mirror)
+	if _, _, err := native.Copy(source.Host()+"/org/app:1", skopeo.CopyOptions{Target: "app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := native.Delete("app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(output, "Deleted "+mirror.Host()+"/app@sha256:") {
+		t.Errorf("unexpected output %q", output)
+	}
+	if _, ok := mirror.manifest("app", "1"); ok {
+		t.Error("app:1 is still in the mirror")
+	}
+
+	// deleting again is not an error
+	output, err = native.Delete("app:1")
+	if err != nil || output != "" || mirror.deletes != 1 {
+		t.Errorf("second delete: %q, %v, %d deletes", output, err, mirror.deletes)
+	}
+}
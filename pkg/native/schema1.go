@@ -0,0 +1,197 @@
+package native
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	client "github.com/gsheet-exporter/internal/registry"
+)
+
+const (
+	MEDIA_TYPE_DOCKER_V1_UNSIGNED = "application/vnd.docker.distribution.manifest.v1+json"
+	MEDIA_TYPE_DOCKER_CONFIG      = "application/vnd.docker.container.image.v1+json"
+	MEDIA_TYPE_DOCKER_LAYER       = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// Legacy image manifest, layers and history are listed from the top layer down
+type schema1Manifest struct {
+	Architecture string `json:"architecture"`
+	FSLayers     []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// Fields of a v1Compatibility entry used by the conversion, the top entry is the image config
+type v1Compatibility struct {
+	Created         string `json:"created,omitempty"`
+	Author          string `json:"author,omitempty"`
+	Comment         string `json:"comment,omitempty"`
+	ThrowAway       bool   `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd,omitempty"`
+	} `json:"container_config,omitempty"`
+}
+
+type schema2History struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Author     string `json:"author,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+type schema2Manifest struct {
+	SchemaVersion int                 `json:"schemaVersion"`
+	MediaType     string              `json:"mediaType"`
+	Config        client.Descriptor   `json:"config"`
+	Layers        []client.Descriptor `json:"layers"`
+}
+
+// v1 image fields without a place in a schema2 config
+var v1OnlyFields = []string{"id", "parent", "parent_id", "layer_id", "Size", "throwaway"}
+
+// Whether the manifest is a legacy schema1 manifest (signed or not)
+func isSchema1(manifest *client.Manifest) bool {
+	mediaType := strings.TrimSpace(strings.Split(manifest.MediaType, ";")[0])
+	if mediaType == client.MEDIA_TYPE_DOCKER_V1 || mediaType == MEDIA_TYPE_DOCKER_V1_UNSIGNED {
+		return true
+	}
+	version := struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}{}
+	return json.Unmarshal(manifest.Body, &version) == nil && version.SchemaVersion == 1
+}
+
+// Convert a schema1 manifest whose layers are already in the mirror to schema2.
+// The config is built from the v1 history, layer diff ids are hashed from the mirrored blobs.
+func (c *copyJob) toSchema2(manifest *client.Manifest) (*client.Manifest, error) {
+	v1 := schema1Manifest{}
+	if err := json.Unmarshal(manifest.Body, &v1); err != nil {
+		return nil, err
+	}
+	if len(v1.History) == 0 || len(v1.History) != len(v1.FSLayers) {
+		return nil, fmt.Errorf("schema1 manifest has %d layers and %d history entries", len(v1.FSLayers), len(v1.History))
+	}
+
+	layers := []client.Descriptor{}
+	diffIDs := []string{}
+	history := []schema2History{}
+	// oldest layer first
+	for i := len(v1.History) - 1; i >= 0; i-- {
+		entry := v1Compatibility{}
+		if err := json.Unmarshal([]byte(v1.History[i].V1Compatibility), &entry); err != nil {
+			return nil, fmt.Errorf("invalid v1Compatibility of layer %d: %v", i, err)
+		}
+		history = append(history, schema2History{
+			Created:    entry.Created,
+			CreatedBy:  strings.Join(entry.ContainerConfig.Cmd, " "),
+			Author:     entry.Author,
+			Comment:    entry.Comment,
+			EmptyLayer: entry.ThrowAway,
+		})
+		if entry.ThrowAway {
+			continue
+		}
+		digest := v1.FSLayers[i].BlobSum
+		diffID, size, err := c.diffID(digest)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, client.Descriptor{MediaType: MEDIA_TYPE_DOCKER_LAYER, Digest: digest, Size: size})
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	// the top entry carries the image config
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(v1.History[0].V1Compatibility), &config); err != nil {
+		return nil, err
+	}
+	for _, field := range v1OnlyFields {
+		delete(config, field)
+	}
+	if _, ok := config["architecture"]; !ok && v1.Architecture != "" {
+		config["architecture"] = v1.Architecture
+	}
+	config["rootfs"] = map[string]interface{}{"type": "layers", "diff_ids": diffIDs}
+	config["history"] = history
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(configBytes))
+	exists, err := c.native.dest.BlobExists(c.destName, configDigest)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := c.native.dest.UploadBlob(c.destName, configDigest, bytes.NewReader(configBytes), "", c.native.ChunkSize); err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := json.Marshal(schema2Manifest{
+		SchemaVersion: 2,
+		MediaType:     client.MEDIA_TYPE_DOCKER_V2,
+		Config:        client.Descriptor{MediaType: MEDIA_TYPE_DOCKER_CONFIG, Digest: configDigest, Size: int64(len(configBytes))},
+		Layers:        layers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &client.Manifest{
+		MediaType: client.MEDIA_TYPE_DOCKER_V2,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(body)),
+		Body:      body,
+	}, nil
+}
+
+// sha256 of the uncompressed layer and the compressed size, read from the mirror
+func (c *copyJob) diffID(digest string) (string, int64, error) {
+	blob, _, err := c.native.dest.GetBlob(c.destName, digest)
+	if err != nil {
+		return "", 0, err
+	}
+	defer blob.Close()
+
+	counter := &countReader{r: blob}
+	gz, err := gzip.NewReader(counter)
+	if err != nil {
+		return "", 0, fmt.Errorf("layer %s is not gzip: %v", digest, err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, gz); err != nil {
+		return "", 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return "", 0, err
+	}
+	// the gzip reader may stop before the end of the blob
+	if _, err := io.Copy(ioutil.Discard, counter); err != nil {
+		return "", 0, err
+	}
+	if counter.n == 0 {
+		return "", 0, errors.New("empty layer blob")
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), counter.n, nil
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
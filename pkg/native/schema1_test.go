@@ -0,0 +1,161 @@
+package native
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	client "github.com/gsheet-exporter/internal/registry"
+)
+
+func gzipped(t *testing.T, content string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Schema1 manifest body, layers and history from the top layer down
+func schema1Body(layers []string, history []string) []byte {
+	fsLayers := []map[string]string{}
+	for _, digest := range layers {
+		fsLayers = append(fsLayers, map[string]string{"blobSum": digest})
+	}
+	entries := []map[string]string{}
+	for _, entry := range history {
+		entries = append(entries, map[string]string{"v1Compatibility": entry})
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 1,
+		"name":          "legacy/app",
+		"tag":           "1",
+		"architecture":  "amd64",
+		"fsLayers":      fsLayers,
+		"history":       entries,
+	})
+	return body
+}
+
+func TestPushV1ConvertsSchema1(t *testing.T) {
+	source, mirror := newTestRegistry(t), newTestRegistry(t)
+	base, app := gzipped(t, "base layer"), gzipped(t, "app layer")
+	baseDigest, appDigest := source.addBlob("legacy/app", base), source.addBlob("legacy/app", app)
+	// an empty layer (throwaway) sits between the two layers
+	emptyDigest := source.addBlob("legacy/app", gzipped(t, ""))
+	body := schema1Body([]string{appDigest, emptyDigest, baseDigest}, []string{
+		`{"id":"c","parent":"b","created":"2016-03-01T00:00:00Z","os":"linux","config":{"Cmd":["/app"]},"container_config":{"Cmd":["/bin/sh","-c","#(nop) COPY app /app"]}}`,
+		`{"id":"b","parent":"a","created":"2016-02-01T00:00:00Z","throwaway":true,"container_config":{"Cmd":["/bin/sh","-c","#(nop) ENV A=1"]}}`,
+		`{"id":"a","created":"2016-01-01T00:00:00Z","author":"ops","container_config":{"Cmd":["/bin/sh","-c","#(nop) ADD base /"]}}`,
+	})
+	source.addManifest("legacy/app", "1", MEDIA_TYPE_DOCKER_V1_UNSIGNED, body)
+
+	image := source.Host() + "/legacy/app:1"
+	if _, err := newTestNative(t, mirror).PushV1(image); err != nil {
+		t.Fatal(err)
+	}
+	pushed, ok := mirror.manifest(source.Host()+"/legacy/app", "1")
+	if !ok {
+		t.Fatal("no manifest pushed")
+	}
+	if pushed.mediaType != client.MEDIA_TYPE_DOCKER_V2 {
+		t.Errorf("pushed %s, want schema2", pushed.mediaType)
+	}
+	manifest := schema2Manifest{}
+	if err := json.Unmarshal(pushed.body, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	// oldest layer first, the throwaway layer left out
+	if len(manifest.Layers) != 2 || manifest.Layers[0].Digest != baseDigest || manifest.Layers[1].Digest != appDigest {
+		t.Fatalf("layers %+v, want base then app", manifest.Layers)
+	}
+	if manifest.Layers[0].Size != int64(len(base)) || manifest.Layers[0].MediaType != MEDIA_TYPE_DOCKER_LAYER {
+		t.Errorf("base layer descriptor %+v", manifest.Layers[0])
+	}
+
+	configBytes, ok := mirror.blob(source.Host()+"/legacy/app", manifest.Config.Digest)
+	if !ok || manifest.Config.Size != int64(len(configBytes)) || manifest.Config.MediaType != MEDIA_TYPE_DOCKER_CONFIG {
+		t.Fatalf("config %+v not uploaded", manifest.Config)
+	}
+	config := struct {
+		ID           string `json:"id"`
+		Parent       string `json:"parent"`
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		RootFS       struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		History []schema2History `json:"history"`
+	}{}
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.ID != "" || config.Parent != "" {
+		t.Errorf("v1 fields kept in the config: id %q, parent %q", config.ID, config.Parent)
+	}
+	if config.Architecture != "amd64" || config.OS != "linux" {
+		t.Errorf("platform %s/%s, want linux/amd64", config.OS, config.Architecture)
+	}
+	wantDiffIDs := []string{
+		fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("base layer"))),
+		fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("app layer"))),
+	}
+	if config.RootFS.Type != "layers" || strings.Join(config.RootFS.DiffIDs, ",") != strings.Join(wantDiffIDs, ",") {
+		t.Errorf("rootfs %+v, want the uncompressed layer digests %v", config.RootFS, wantDiffIDs)
+	}
+	if len(config.History) != 3 || !config.History[1].EmptyLayer || config.History[0].Author != "ops" ||
+		config.History[2].CreatedBy != "/bin/sh -c #(nop) COPY app /app" {
+		t.Errorf("history %+v", config.History)
+	}
+}
+
+func TestToSchema2RejectsInvalidManifests(t *testing.T) {
+	mirror := newTestRegistry(t)
+	notGzip := mirror.addBlob("legacy/app", []byte("plain layer"))
+	job := &copyJob{native: newTestNative(t, mirror), destName: "legacy/app"}
+
+	tests := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"history mismatch", schema1Body([]string{notGzip, notGzip}, []string{`{"id":"a"}`}), "2 layers and 1 history entries"},
+		{"no history", schema1Body(nil, nil), "0 layers and 0 history entries"},
+		{"invalid v1Compatibility", schema1Body([]string{notGzip}, []string{`{"id":`}), "invalid v1Compatibility"},
+		{"layer not gzip", schema1Body([]string{notGzip}, []string{`{"id":"a"}`}), "is not gzip"},
+	}
+	for _, test := range tests {
+		_, err := job.toSchema2(&client.Manifest{MediaType: MEDIA_TYPE_DOCKER_V1_UNSIGNED, Body: test.body})
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestIsSchema1(t *testing.T) {
+	tests := []struct {
+		manifest client.Manifest
+		want     bool
+	}{
+		{client.Manifest{MediaType: client.MEDIA_TYPE_DOCKER_V1}, true},
+		{client.Manifest{MediaType: MEDIA_TYPE_DOCKER_V1_UNSIGNED + "; charset=utf-8"}, true},
+		// registries answering schema1 as plain json
+		{client.Manifest{MediaType: "application/json", Body: []byte(`{"schemaVersion":1}`)}, true},
+		{client.Manifest{MediaType: client.MEDIA_TYPE_DOCKER_V2, Body: []byte(`{"schemaVersion":2}`)}, false},
+		{client.Manifest{MediaType: "application/json", Body: []byte(`not json`)}, false},
+	}
+	for _, test := range tests {
+		if got := isSchema1(&test.manifest); got != test.want {
+			t.Errorf("isSchema1(%s %s) = %v, want %v", test.manifest.MediaType, test.manifest.Body, got, test.want)
+		}
+	}
+}
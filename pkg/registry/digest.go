@@ -0,0 +1,220 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+
+	client "github.com/gsheet-exporter/internal/registry"
+)
+
+// Digest of the image stored in the mirror, empty when it is not there
+func (registry *Registry) MirrorDigest(image string, opts MirrorOptions) (string, error) {
+	ref, err := ParseNormalized(image)
+	if err != nil {
+		return "", err
+	}
+	manifestRef := ref.Tag
+	if manifestRef == "" {
+		manifestRef = ref.Digest
+	}
+	digest, _, err := registry.client.ManifestDigest(ref.MirrorName(opts.Target), manifestRef)
+	return digest, err
+}
+
+// Whether the mirror copy of the image is missing or differs from the wanted content
+func (registry *Registry) isStale(ref Reference, opts MirrorOptions) (bool, error) {
+	name := ref.MirrorName(opts.Target)
+	// digest only: the content is fixed, only its presence matters
+	if ref.Tag == "" {
+		_, found, err := registry.client.ManifestDigest(name, ref.Digest)
+		return !found, err
+	}
+
+	mirrorDigest, found, err := registry.client.ManifestDigest(name, ref.Tag)
+	if err != nil || !found {
+		return !found, err
+	}
+	mirror, found, err := registry.client.GetManifest(name, mirrorDigest)
+	if err != nil || !found {
+		return !found, err
+	}
+	if opts.MultiArch && !mirror.IsList() {
+		log.Info.Printf("%s: mirror has a single platform, copying every platform", ref.Familiar())
+		return true, nil
+	}
+	// the platform column changed since the copy (ex. system -> linux/arm64)
+	if !opts.MultiArch {
+		matched, err := registry.mirrorPlatform(name, mirror, opts.Platform)
+		if err != nil {
+			return false, err
+		}
+		if !matched {
+			log.Info.Printf("%s: mirror has no %s image, copying it", ref.Familiar(), wantedPlatform(opts.Platform))
+			return true, nil
+		}
+	}
+
+	// the manifest the mirror should hold: the digest pinned in the sheet or, with CheckUpstream, the source tag
+	wanted := ref.Digest
+	if wanted == "" {
+		if !registry.opts.CheckUpstream {
+			return false, nil
+		}
+		// HEAD first, docker hub counts manifest GETs against the pull rate limit
+		upstreamDigest, found, err := registry.upstreamDigest(ref)
+		if err != nil {
+			// a source registry down or rate limited must not re-copy the whole sheet
+			log.Warn.Printf("Cannot Get upstream digest of %s, keeping the mirrored image: %v", ref.Familiar(), err)
+			return false, nil
+		}
+		if !found {
+			log.Warn.Printf("%s no longer exists upstream, keeping the mirrored image", ref.Familiar())
+			return false, nil
+		}
+		wanted = upstreamDigest
+	}
+	if mirrorDigest == wanted {
+		return false, nil
+	}
+	// a whole list must match exactly
+	if opts.MultiArch {
+		log.Info.Printf("%s: mirror has %s, wanted %s", ref.Familiar(), mirrorDigest, wanted)
+		return true, nil
+	}
+	// a single platform is the listed manifest of that platform, only then the list is fetched
+	upstream, err := registry.upstreamManifest(ref, wanted)
+	if err != nil {
+		log.Warn.Printf("Cannot Get upstream manifest of %s, keeping the mirrored image: %v", ref.Familiar(), err)
+		return false, nil
+	}
+	if upstream == nil || !matchManifest(mirrorDigest, upstream, opts.Platform) {
+		log.Info.Printf("%s: mirror has %s, wanted %s", ref.Familiar(), mirrorDigest, wanted)
+		return true, nil
+	}
+	return false, nil
+}
+
+// Whether the mirrored manifest holds an image of the platform, a list holds every platform.
+// Manifests without a readable config (schema1) are not checked.
+func (registry *Registry) mirrorPlatform(name string, mirror *client.Manifest, platform string) (bool, error) {
+	if mirror.IsList() {
+		return true, nil
+	}
+	config, err := mirror.Config()
+	if err != nil || config == nil {
+		return true, nil
+	}
+	body, _, err := registry.client.GetBlob(name, config.Digest)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+	image := client.Platform{}
+	if err := json.NewDecoder(body).Decode(&image); err != nil || image.OS == "" {
+		return true, nil
+	}
+	return samePlatform(image, wantedPlatform(platform)), nil
+}
+
+// Digest of the tag in the image's source registry (HEAD request)
+func (registry *Registry) upstreamDigest(ref Reference) (string, bool, error) {
+	upstreamClient, err := registry.upstream(ref)
+	if err != nil {
+		return "", false, err
+	}
+	registry.waitUpstream(ref)
+	return upstreamClient.ManifestDigest(ref.Path, ref.Tag)
+}
+
+// Manifest of the digest in the image's source registry, nil when it does not exist
+func (registry *Registry) upstreamManifest(ref Reference, digest string) (*client.Manifest, error) {
+	upstreamClient, err := registry.upstream(ref)
+	if err != nil {
+		return nil, err
+	}
+	registry.waitUpstream(ref)
+	manifest, found, err := upstreamClient.GetManifest(ref.Path, digest)
+	if err != nil || !found {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Take a request slot of the source registry's rate limit
+func (registry *Registry) waitUpstream(ref Reference) {
+	if registry.opts.UpstreamWait != nil {
+		registry.opts.UpstreamWait(ref.Domain)
+	}
+}
+
+// Client of the image's source registry, shared by the images of the same host
+func (registry *Registry) upstream(ref Reference) (*client.Client, error) {
+	host := ref.RegistryHost()
+	cred := ""
+	if registry.opts.UpstreamCred != nil {
+		cred = registry.opts.UpstreamCred(ref.String())
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	key := host + " " + cred
+	if upstreamClient, ok := registry.upstreams[key]; ok {
+		return upstreamClient, nil
+	}
+	opts := client.Options{}
+	if cred != "" {
+		userPass := strings.SplitN(cred, ":", 2)
+		if len(userPass) != 2 {
+			return nil, fmt.Errorf("cred of %s must be 'user:pass'", host)
+		}
+		opts.Username, opts.Password = userPass[0], userPass[1]
+	}
+	upstreamClient, err := client.NewClient(host, opts)
+	if err != nil {
+		return nil, err
+	}
+	registry.upstreams[key] = upstreamClient
+	return upstreamClient, nil
+}
+
+// The mirror digest matches the upstream manifest itself or, for a multi-arch list copied
+// as a single platform, the listed manifest of that platform
+func matchManifest(mirrorDigest string, upstream *client.Manifest, platform string) bool {
+	if !upstream.IsList() {
+		return mirrorDigest == upstream.Digest
+	}
+	children, err := upstream.Children()
+	if err != nil {
+		return false
+	}
+	want := wantedPlatform(platform)
+	for _, manifest := range children {
+		if manifest.Platform != nil && samePlatform(*manifest.Platform, want) {
+			return manifest.Digest == mirrorDigest
+		}
+	}
+	return false
+}
+
+// Platform copied from a list: "os/arch[/variant]", empty is the host platform
+func wantedPlatform(platform string) client.Platform {
+	if platform == "" {
+		return client.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	}
+	parts := strings.Split(platform, "/")
+	want := client.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) > 2 {
+		want.Variant = parts[2]
+	}
+	return want
+}
+
+// A wanted platform without variant matches any variant, as skopeo and the native copy select it
+func samePlatform(platform, want client.Platform) bool {
+	if platform.OS != want.OS || platform.Architecture != want.Architecture {
+		return false
+	}
+	return want.Variant == "" || platform.Variant == want.Variant
+}
@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 100 // default "n" of distribution
+)
+
+// Iterate all repositories of the registry following the catalog pagination
+//
+//	it := registry.Repositories()
+//	for it.Next() {
+//		repo := it.Repository()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type RepositoryIterator struct {
+	registry *Registry
+	page     []string
+	next     string
+	started  bool
+	current  string
+	err      error
+}
+
+// Iterate all tags of an image repository following the tags pagination
+type TagIterator struct {
+	registry *Registry
+	image    string
+	page     []string
+	next     string
+	started  bool
+	current  string
+	err      error
+}
+
+// Error body returned by the registry (e.g. NAME_UNKNOWN)
+type ResponseError struct {
+	Image  string
+	Errors []ErrorsImage
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("image: %s, error code: %v", e.Image, e.Errors)
+}
+
+// Whether the registry reported the repository does not exist
+func (e *ResponseError) NameUnknown() bool {
+	for _, v := range e.Errors {
+		if v.Code == "NAME_UNKNOWN" {
+			return true
+		}
+	}
+	return false
+}
+
+func (registry *Registry) Repositories() *RepositoryIterator {
+	return &RepositoryIterator{registry: registry}
+}
+
+func (it *RepositoryIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || (it.started && it.next == "") {
+			return false
+		}
+		it.started = true
+		body, next, err := it.registry.client.CatalogPage(it.next, it.registry.pageSize)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		catalog := Catalog{}
+		if err := json.Unmarshal([]byte(body), &catalog); err != nil {
+			it.err = fmt.Errorf("cannot parse catalog json: %s, %v", body, err)
+			return false
+		}
+		it.page = catalog.Repositories
+		it.next = next
+	}
+	it.current = it.page[0]
+	it.page = it.page[1:]
+	return true
+}
+
+func (it *RepositoryIterator) Repository() string {
+	return it.current
+}
+
+func (it *RepositoryIterator) Err() error {
+	return it.err
+}
+
+func (registry *Registry) Tags(image string) *TagIterator {
+	return &TagIterator{registry: registry, image: image}
+}
+
+func (it *TagIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || (it.started && it.next == "") {
+			return false
+		}
+		it.started = true
+		body, next, err := it.registry.client.TagsPage(it.image, it.next, it.registry.pageSize)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		img := Image{}
+		if err := json.Unmarshal([]byte(body), &img); err != nil {
+			it.err = fmt.Errorf("cannot parse image json: %s, %v", body, err)
+			return false
+		}
+		if img.Errors != nil {
+			it.err = &ResponseError{Image: it.image, Errors: img.Errors}
+			return false
+		}
+		it.page = img.Tags
+		it.next = next
+	}
+	it.current = it.page[0]
+	it.page = it.page[1:]
+	return true
+}
+
+func (it *TagIterator) Tag() string {
+	return it.current
+}
+
+func (it *TagIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Registry paging the catalog and tags lists by "last", with the Link header built by link
+func newPagingRegistry(t *testing.T, repos map[string][]string, link func(path, last string, n int) string) *Registry {
+	names := []string{}
+	for name := range repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		n := 0
+		fmt.Sscan(query.Get("n"), &n)
+		list, key := names, "repositories"
+		if strings.HasSuffix(req.URL.Path, "/tags/list") {
+			repo := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v2/"), "/tags/list")
+			tags, ok := repos[repo]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"errors":[{"code":"NAME_UNKNOWN","message":"repository name not known to registry"}]}`)
+				return
+			}
+			list, key = tags, "tags"
+		}
+		start := 0
+		for start < len(list) && query.Get("last") != "" && list[start] <= query.Get("last") {
+			start++
+		}
+		end := start + n
+		if end >= len(list) {
+			end = len(list)
+		} else if header := link(req.URL.Path, list[end-1], n); header != "" {
+			w.Header().Set("Link", header)
+		}
+		page := `"` + strings.Join(list[start:end], `","`) + `"`
+		if start == end {
+			page = ""
+		}
+		fmt.Fprintf(w, `{"%s":[%s]}`, key, page)
+	}))
+	t.Cleanup(server.Close)
+
+	registry, err := NewRegistry(server.URL, Options{PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func relativeLink(path, last string, n int) string {
+	return fmt.Sprintf(`<%s?last=%s&n=%d>; rel="next"`, path, last, n)
+}
+
+func allRepositories(registry *Registry) ([]string, error) {
+	repos := []string{}
+	it := registry.Repositories()
+	for it.Next() {
+		repos = append(repos, it.Repository())
+	}
+	return repos, it.Err()
+}
+
+func TestCatalogPages(t *testing.T) {
+	repos := map[string][]string{"a": {"1"}, "b": {"1"}, "c": {"1"}, "d": {"1"}, "e": {"1"}}
+	registry := newPagingRegistry(t, repos, relativeLink)
+
+	got, err := allRepositories(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "a,b,c,d,e" {
+		t.Errorf("repositories %v, want every page", got)
+	}
+}
+
+func TestTagPagesWithAbsoluteLink(t *testing.T) {
+	repos := map[string][]string{"org/app": {"1", "2", "3", "4"}}
+	var registry *Registry
+	registry = newPagingRegistry(t, repos, func(path, last string, n int) string {
+		return fmt.Sprintf(`<%s%s?n=%d&last=%s>; rel="next"`, registry.url, path, n, last)
+	})
+
+	tags := []string{}
+	it := registry.Tags("org/app")
+	for it.Next() {
+		tags = append(tags, it.Tag())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, ",") != "1,2,3,4" {
+		t.Errorf("tags %v", tags)
+	}
+
+	found, err := registry.HasTag("org/app", "4")
+	if err != nil || !found {
+		t.Errorf("tag on the last page not found: %v", err)
+	}
+}
+
+func TestLinkWithoutNext(t *testing.T) {
+	repos := map[string][]string{"a": {"1"}, "b": {"1"}, "c": {"1"}}
+	registry := newPagingRegistry(t, repos, func(path, last string, n int) string {
+		// only a link to the previous page
+		return fmt.Sprintf(`<%s?n=%d>; rel="prev"`, path, n)
+	})
+
+	got, err := allRepositories(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "a,b" {
+		t.Errorf("repositories %v, want the first page only", got)
+	}
+}
+
+func TestLinkToAnotherHost(t *testing.T) {
+	repos := map[string][]string{"a": {"1"}, "b": {"1"}, "c": {"1"}}
+	registry := newPagingRegistry(t, repos, func(path, last string, n int) string {
+		return fmt.Sprintf(`<https://evil.example.com%s?last=%s>; rel="next"`, path, last)
+	})
+
+	if _, err := allRepositories(registry); err == nil || !strings.Contains(err.Error(), "another host") {
+		t.Errorf("link to another host followed: %v", err)
+	}
+}
+
+func TestFindDeleteImageListReadsEveryPage(t *testing.T) {
+	repos := map[string][]string{"nginx": {"1.24", "1.25", "1.26"}, "redis": {"7"}, "team/app": {"1", "2"}}
+	registry := newPagingRegistry(t, repos, relativeLink)
+
+	deleteList, total := registry.FindDeleteImageList([]string{"nginx:1.25", "team/app:2"})
+	if total != 6 {
+		t.Errorf("%d images counted, want 6", total)
+	}
+	if strings.Join(deleteList, ",") != "nginx:1.24,nginx:1.26,redis:7,team/app:1" {
+		t.Errorf("delete list %v", deleteList)
+	}
+}
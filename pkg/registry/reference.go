@@ -0,0 +1,164 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	DEFAULT_DOMAIN        = "docker.io"
+	LEGACY_DEFAULT_DOMAIN = "index.docker.io"
+	OFFICIAL_REPO_PREFIX  = "library/"
+	DEFAULT_TAG           = "latest"
+	DOCKER_HUB_REGISTRY   = "registry-1.docker.io" // registry API host of docker.io
+)
+
+// Image reference: [domain/]path[:tag][@digest]
+type Reference struct {
+	Domain string `json:"domain,omitempty"`
+	Path   string `json:"path"`
+	Tag    string `json:"tag,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+var (
+	domainRegexp    = regexp.MustCompile(`^(?:localhost|(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*)(?::[0-9]+)?$`)
+	componentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	tagRegexp       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp    = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+)
+
+// Parse the reference as written, without defaults
+func ParseReference(s string) (Reference, error) {
+	ref := Reference{}
+	if s == "" {
+		return ref, fmt.Errorf("empty image reference")
+	}
+	name := s
+
+	if idx := strings.Index(name, "@"); idx >= 0 {
+		ref.Digest = name[idx+1:]
+		name = name[:idx]
+		if !digestRegexp.MatchString(ref.Digest) {
+			return ref, fmt.Errorf("invalid digest %q in %s", ref.Digest, s)
+		}
+	}
+	// a ":" after the last "/" separates the tag, before it the registry port
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		ref.Tag = name[idx+1:]
+		name = name[:idx]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid tag %q in %s", ref.Tag, s)
+		}
+	}
+	// the first component is a registry host when it looks like one
+	if idx := strings.Index(name, "/"); idx >= 0 {
+		first := name[:idx]
+		if strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first {
+			if !domainRegexp.MatchString(first) {
+				return ref, fmt.Errorf("invalid registry host %q in %s", first, s)
+			}
+			ref.Domain = first
+			name = name[idx+1:]
+		}
+	}
+	if name == "" {
+		return ref, fmt.Errorf("empty repository name in %s", s)
+	}
+	for _, component := range strings.Split(name, "/") {
+		if !componentRegexp.MatchString(component) {
+			return ref, fmt.Errorf("invalid repository name %q in %s", name, s)
+		}
+	}
+	ref.Path = name
+	return ref, nil
+}
+
+// Parse with docker defaults: nginx -> docker.io/library/nginx:latest
+func ParseNormalized(s string) (Reference, error) {
+	ref, err := ParseReference(s)
+	if err != nil {
+		return ref, err
+	}
+	if ref.Domain == "" || ref.Domain == LEGACY_DEFAULT_DOMAIN {
+		ref.Domain = DEFAULT_DOMAIN
+	}
+	if ref.Domain == DEFAULT_DOMAIN && !strings.Contains(ref.Path, "/") {
+		ref.Path = OFFICIAL_REPO_PREFIX + ref.Path
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DEFAULT_TAG
+	}
+	return ref, nil
+}
+
+// Host serving the registry API of the domain (docker.io -> registry-1.docker.io)
+func (ref Reference) RegistryHost() string {
+	if ref.Domain == DEFAULT_DOMAIN || ref.Domain == LEGACY_DEFAULT_DOMAIN {
+		return DOCKER_HUB_REGISTRY
+	}
+	return ref.Domain
+}
+
+// domain/path
+func (ref Reference) Name() string {
+	if ref.Domain == "" {
+		return ref.Path
+	}
+	return ref.Domain + "/" + ref.Path
+}
+
+// Name without docker hub defaults (docker.io/library/nginx -> nginx), the mirror repository path
+func (ref Reference) FamiliarName() string {
+	if ref.Domain != DEFAULT_DOMAIN && ref.Domain != "" {
+		return ref.Name()
+	}
+	return strings.TrimPrefix(ref.Path, OFFICIAL_REPO_PREFIX)
+}
+
+// Mirror repository of the image, target overrides the familiar name
+func (ref Reference) MirrorName(target string) string {
+	if target != "" {
+		return target
+	}
+	return ref.FamiliarName()
+}
+
+// "repository:tag" stored in the mirror, empty for an image pinned by digest only
+func (ref Reference) MirrorTag(target string) string {
+	if ref.Tag == "" {
+		return ""
+	}
+	return ref.MirrorName(target) + ":" + ref.Tag
+}
+
+func (ref Reference) String() string {
+	return ref.Name() + ref.suffix()
+}
+
+// Familiar name with tag and digest, as written in the sheet and stored in the mirror
+func (ref Reference) Familiar() string {
+	return ref.FamiliarName() + ref.suffix()
+}
+
+func (ref Reference) suffix() string {
+	s := ""
+	if ref.Tag != "" {
+		s += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		s += "@" + ref.Digest
+	}
+	return s
+}
+
+// Normalize the image to its familiar form with a tag ("nginx" -> "nginx:latest").
+// Invalid references are returned unchanged with the error.
+func Normalize(image string) (string, error) {
+	ref, err := ParseNormalized(strings.TrimSpace(image))
+	if err != nil {
+		return image, err
+	}
+	return ref.Familiar(), nil
+}
@@ -0,0 +1,111 @@
+package registry
+
+import "testing"
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		image string
+		want  Reference
+	}{
+		{"nginx", Reference{Path: "nginx"}},
+		{"nginx:1.25", Reference{Path: "nginx", Tag: "1.25"}},
+		{"library/nginx:1.25", Reference{Path: "library/nginx", Tag: "1.25"}},
+		{"docker.io/library/nginx:1.25", Reference{Domain: "docker.io", Path: "library/nginx", Tag: "1.25"}},
+		{"quay.io/org/app:1", Reference{Domain: "quay.io", Path: "org/app", Tag: "1"}},
+		{"mirror:5000/org/app", Reference{Domain: "mirror:5000", Path: "org/app"}},
+		{"mirror.local:5000/org/app:1", Reference{Domain: "mirror.local:5000", Path: "org/app", Tag: "1"}},
+		{"localhost/app:1", Reference{Domain: "localhost", Path: "app", Tag: "1"}},
+		{"localhost:5000/app", Reference{Domain: "localhost:5000", Path: "app"}},
+		{"nginx@" + testDigest, Reference{Path: "nginx", Digest: testDigest}},
+		{"nginx:1.25@" + testDigest, Reference{Path: "nginx", Tag: "1.25", Digest: testDigest}},
+		{"mirror:5000/org/app:1@" + testDigest, Reference{Domain: "mirror:5000", Path: "org/app", Tag: "1", Digest: testDigest}},
+		// an upper case first component is a host, not a repository
+		{"Registry/app", Reference{Domain: "Registry", Path: "app"}},
+	}
+	for _, test := range tests {
+		got, err := ParseReference(test.image)
+		if err != nil || got != test.want {
+			t.Errorf("ParseReference(%q) = %+v, %v, want %+v", test.image, got, err, test.want)
+		}
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	for _, image := range []string{
+		"",
+		"Nginx",
+		"nginx:",
+		"nginx:-1",
+		"nginx@sha256:abc",
+		"nginx@" + testDigest + "x",
+		"bad image",
+		"org//app",
+		"quay.io/",
+		"-bad-host.io/app",
+		"nginx:1.25:2",
+	} {
+		if ref, err := ParseReference(image); err == nil {
+			t.Errorf("ParseReference(%q) = %+v, want an error", image, ref)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		image    string
+		want     string
+		name     string // ParseNormalized name
+		mirror   string // mirrored "repository:tag"
+		registry string // registry API host
+	}{
+		{"nginx", "nginx:latest", "docker.io/library/nginx", "nginx:latest", DOCKER_HUB_REGISTRY},
+		{" nginx:1.25 ", "nginx:1.25", "docker.io/library/nginx", "nginx:1.25", DOCKER_HUB_REGISTRY},
+		{"library/nginx:1.25", "nginx:1.25", "docker.io/library/nginx", "nginx:1.25", DOCKER_HUB_REGISTRY},
+		{"docker.io/library/nginx:1.25", "nginx:1.25", "docker.io/library/nginx", "nginx:1.25", DOCKER_HUB_REGISTRY},
+		{"index.docker.io/library/nginx:1.25", "nginx:1.25", "docker.io/library/nginx", "nginx:1.25", DOCKER_HUB_REGISTRY},
+		{"bitnami/redis:7", "bitnami/redis:7", "docker.io/bitnami/redis", "bitnami/redis:7", DOCKER_HUB_REGISTRY},
+		{"quay.io/org/app", "quay.io/org/app:latest", "quay.io/org/app", "quay.io/org/app:latest", "quay.io"},
+		// no library/ prefix outside of docker hub
+		{"quay.io/app:1", "quay.io/app:1", "quay.io/app", "quay.io/app:1", "quay.io"},
+		{"mirror.local:5000/app:1", "mirror.local:5000/app:1", "mirror.local:5000/app", "mirror.local:5000/app:1", "mirror.local:5000"},
+		{"localhost:5000/app", "localhost:5000/app:latest", "localhost:5000/app", "localhost:5000/app:latest", "localhost:5000"},
+		{"localhost/app", "localhost/app:latest", "localhost/app", "localhost/app:latest", "localhost"},
+		// a digest without a tag gets no default tag, nothing is mirrored under a tag
+		{"nginx@" + testDigest, "nginx@" + testDigest, "docker.io/library/nginx", "", DOCKER_HUB_REGISTRY},
+		{"nginx:1.25@" + testDigest, "nginx:1.25@" + testDigest, "docker.io/library/nginx", "nginx:1.25", DOCKER_HUB_REGISTRY},
+	}
+	for _, test := range tests {
+		got, err := Normalize(test.image)
+		if err != nil || got != test.want {
+			t.Errorf("Normalize(%q) = %q, %v, want %q", test.image, got, err, test.want)
+		}
+		ref, err := ParseNormalized(test.image)
+		if err != nil {
+			// Normalize trims the image, ParseNormalized does not
+			continue
+		}
+		if ref.Name() != test.name || ref.MirrorTag("") != test.mirror || ref.RegistryHost() != test.registry {
+			t.Errorf("ParseNormalized(%q) = %s, mirror %q, registry %s, want %s, %q, %s",
+				test.image, ref.Name(), ref.MirrorTag(""), ref.RegistryHost(), test.name, test.mirror, test.registry)
+		}
+	}
+
+	if got, err := Normalize("bad image"); err == nil || got != "bad image" {
+		t.Errorf("Normalize of an invalid image = %q, %v, want it unchanged with an error", got, err)
+	}
+}
+
+func TestMirrorNameTarget(t *testing.T) {
+	ref, err := ParseNormalized("quay.io/org/app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ref.MirrorTag("team/app"); got != "team/app:1" {
+		t.Errorf("MirrorTag with a target = %q", got)
+	}
+	if got := ref.MirrorName(""); got != "quay.io/org/app" {
+		t.Errorf("MirrorName without a target = %q", got)
+	}
+}
@@ -1,10 +1,10 @@
 package registry
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	client "github.com/gsheet-exporter/internal/registry"
 	"github.com/gsheet-exporter/pkg/logger"
@@ -22,7 +22,33 @@ type ErrorsImage struct {
 }
 
 type Registry struct {
-	url string
+	url      string
+	client   *client.Client
+	pageSize int
+
+	opts      Options
+	mu        sync.Mutex
+	upstreams map[string]*client.Client // source registry host -> client
+}
+
+// Connection options of the registry server
+type Options struct {
+	Cred     string // "user:pass" for basic auth or the token service
+	CAFile   string
+	Insecure bool
+	PageSize int // "n" of catalog and tags list requests
+
+	// compare a mirrored tag with the source registry's digest, re-copying retagged images
+	CheckUpstream bool
+	UpstreamCred  func(image string) string // "user:pass" for the image's source registry, empty for anonymous
+	UpstreamWait  func(domain string)       // blocks until the source registry's rate limit allows a request
+}
+
+// How a sheet image is stored in the mirror
+type MirrorOptions struct {
+	MultiArch bool   // mirrored as a whole manifest list, a single platform copy is stale
+	Platform  string // single platform copied from a list ("linux/arm64"), empty: the host platform
+	Target    string // mirror repository, empty: the familiar name
 }
 
 type Catalog struct {
@@ -33,20 +59,47 @@ var (
 	log = logger.GetInstance()
 )
 
-func NewRegistry(registryUrl string) (*Registry, error) {
+func NewRegistry(registryUrl string, opts Options) (*Registry, error) {
 	if registryUrl == "" {
 		err := errors.New("url is empty")
 		return nil, err
 	}
 
+	clientOpts := client.Options{
+		CAFile:   opts.CAFile,
+		Insecure: opts.Insecure,
+	}
+	if opts.Cred != "" {
+		cred := strings.SplitN(opts.Cred, ":", 2)
+		if len(cred) != 2 {
+			return nil, errors.New("registry cred must be 'user:pass'")
+		}
+		clientOpts.Username = cred[0]
+		clientOpts.Password = cred[1]
+	}
+	registryClient, err := client.NewClient(registryUrl, clientOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DEFAULT_PAGE_SIZE
+	}
+
 	return &Registry{
-		url: registryUrl,
+		url:      registryUrl,
+		client:   registryClient,
+		pageSize: pageSize,
+
+		opts:      opts,
+		upstreams: map[string]*client.Client{},
 	}, nil
 }
 
 // registry alive check
 func (registry *Registry) GetRegistry() error {
-	err := client.Ping(registry.url)
+	err := registry.client.Ping()
 	if err != nil {
 		log.Error.Printf("%s", err)
 		return err
@@ -57,104 +110,88 @@ func (registry *Registry) GetRegistry() error {
 }
 
 // Use the image list parsed from Google Sheet to find if there is an image in the registry.
+// An image is copied when the mirror has no manifest for it or its digest differs from the
+// pinned digest ("name:tag@sha256:...") or, with CheckUpstream, from the source registry.
+// mirror holds the options of images not stored as their familiar name or as a single platform.
 // 구글시트에서 파싱한 이미지 리스트를 활용해 레지스트리 내 이미지가 있는지 찾는다.
-func (registry *Registry) FindCopyImageList(imageList []string) ([]string, []string) {
+func (registry *Registry) FindCopyImageList(imageList []string, mirror map[string]MirrorOptions) ([]string, []string) {
 	copyImageList := []string{}
 	findFailImgList := []string{}
-	imgJsonStruct := Image{}
 
 	for _, image := range imageList {
-		img := strings.Split(image, ":")
-		// 이미지에 tag가 안들어갔을 경우 예외 처리
-		if len(img) <= 1 {
-			log.Error.Printf("Image has not tag: %s\n", image)
+		ref, err := ParseNormalized(image)
+		// 이미지 이름이 잘못된 경우 예외 처리 (tag가 없으면 latest)
+		if err != nil {
+			log.Error.Printf("Invalid image reference: %v\n", err)
 			findFailImgList = append(findFailImgList, image)
 			continue
 		}
-		imageName := img[0]
-		imageTag := img[1]
 
-		res, err := client.ListTags(registry.url, imageName)
-		// registry 서버에 문제가 생겼을 때 반환되는 에러
+		stale, err := registry.isStale(ref, mirror[image])
 		if err != nil {
-			log.Error.Printf("Cannot Get image tags from Registry Server : %v", err)
+			// registry 서버에 문제가 생겼거나 응답을 읽지 못했을 때 반환되는 에러
+			log.Error.Printf("Cannot Get image manifest from Registry Server : %v", err)
 			findFailImgList = append(findFailImgList, image)
-		} else { // 'tags' 데이터 파싱 후 imageTag와 비교해 있으면 true, 없으면 false
-			err = json.Unmarshal([]byte(res), &imgJsonStruct)
-			if err != nil {
-				log.Error.Printf("Cannot Parse Image Json to Struct : %v", err)
-				// 이 에러는 json to struct에 문제가 있을 때 반환되는 에러
-				findFailImgList = append(findFailImgList, image)
-			} else {
-				flags := false
-				for _, v := range imgJsonStruct.Tags {
-					if v == imageTag {
-						flags = true
-						break
-					}
-				}
-				// false인 이미지 저장
-				if flags == false {
-					copyImageList = append(copyImageList, image)
-				}
-			}
+			continue
+		}
+		// mirror에 없거나 digest가 다른 이미지 저장
+		if stale {
+			copyImageList = append(copyImageList, image)
 		}
 	}
 
 	return copyImageList, findFailImgList
 }
 
-// Find delete image list that registry save image but not in sheet image list
-func (registry *Registry) FindDeleteImageList(imageList []string) []string {
-	deleteImageList := []string{}
-	CatalogJsonStruct := Catalog{}
-	imgJsonStruct := Image{}
-
-	// get image repositories in registry
-	getCatalog, err := client.Catalog(registry.url)
-	if err != nil {
-		log.Error.Printf("Cannot Get image list from Registry Server: %v", err)
-		return nil
+// Whether the image tag is stored in the registry, a repository never pushed has no tags
+func (registry *Registry) HasTag(image, tag string) (bool, error) {
+	it := registry.Tags(image)
+	for it.Next() {
+		if it.Tag() == tag {
+			return true, nil
+		}
 	}
-	err = json.Unmarshal([]byte(getCatalog), &CatalogJsonStruct)
-	if err != nil {
-		log.Error.Printf("Cannot Parse Catalog Json to Struct: %s, %v", getCatalog, err)
-		return nil
+	if respErr, ok := it.Err().(*ResponseError); ok && respErr.NameUnknown() {
+		return false, nil
 	}
-	// find image list used repositories
-	i := 1
-	for _, repo := range CatalogJsonStruct.Repositories {
-		getTags, err := client.ListTags(registry.url, repo)
-		if err != nil {
-			log.Error.Printf("Cannot Get image tags from Registry Server: %s, %v", repo, err)
-			continue
-		}
-		err = json.Unmarshal([]byte(getTags), &imgJsonStruct)
-		if err != nil {
-			log.Error.Printf("Cannot Parse Image Json to Struct: %s, %v", getTags, err)
-			continue
-		}
-		// 한번이라도 저장된 적이 없는 이미지 패싱
-		if imgJsonStruct.Errors != nil {
-			log.Error.Printf("Image: %s, Error Code: %v", repo, imgJsonStruct.Errors)
-			imgJsonStruct.Errors = nil
-			continue
-		}
+	return false, it.Err()
+}
+
+// Find delete image list that registry save image but not in sheet image list.
+// keep lists the mirrored "repository:tag" of the sheet rows (Reference.MirrorTag).
+// The number of images stored in the registry is returned together.
+func (registry *Registry) FindDeleteImageList(keep []string) ([]string, int) {
+	deleteImageList := []string{}
+	sheetImages := keep
 
-		for _, tags := range imgJsonStruct.Tags {
-			image := fmt.Sprintf("%s:%s", repo, tags)
+	// find image list used repositories (every catalog page)
+	i := 1
+	repos := registry.Repositories()
+	for repos.Next() {
+		repo := repos.Repository()
+		tags := registry.Tags(repo)
+		for tags.Next() {
+			image := fmt.Sprintf("%s:%s", repo, tags.Tag())
 			log.Info.Printf("[%d] %s", i, image)
 			// search delete image
-			found := search(imageList, image)
+			found := search(sheetImages, image)
 			if !found {
 				deleteImageList = append(deleteImageList, image)
 			}
 			i = i + 1
 		}
-
+		// 한번이라도 저장된 적이 없는 이미지 패싱
+		if err := tags.Err(); err != nil {
+			log.Error.Printf("Cannot Get image tags from Registry Server: %s, %v", repo, err)
+			continue
+		}
+	}
+	if err := repos.Err(); err != nil {
+		log.Error.Printf("Cannot Get image list from Registry Server: %v", err)
+		return nil, 0
 	}
 
-	return deleteImageList
+	return deleteImageList, i - 1
 }
 
 func search(list []string, image string) bool {
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gsheet-exporter/internal/command"
+	client "github.com/gsheet-exporter/internal/registry"
+	"github.com/gsheet-exporter/pkg/gsheet"
+	"github.com/gsheet-exporter/pkg/native"
+	"github.com/gsheet-exporter/pkg/registry"
+)
+
+// Registry storage layout (distribution filesystem driver)
+const (
+	STORAGE_REPOSITORIES = "docker/registry/v2/repositories"
+	STORAGE_BLOBS        = "docker/registry/v2/blobs"
+)
+
+// Members of a repository directory holding its own data, other directories are nested repositories ("org/app/sub")
+var repositoryMembers = []string{"_manifests", "_layers", "_uploads"}
+
+// tar --exclude members of excluded images in the registry storage under archivePath.
+// A repository keeping no tag is left out (not its nested repositories), otherwise the excluded tags
+// with the revisions and layer links no kept tag references, so an excluded image cannot be pulled
+// by digest from the archive either. Blobs of the shared blob store that no archived repository
+// links are left out too.
+func excludeMembers(archivePath string, rows []gsheet.Row) []string {
+	repositories := filepath.Join(archivePath, STORAGE_REPOSITORIES)
+	if _, err := os.Stat(repositories); err != nil {
+		log.Warn.Printf("No registry storage in %s, excluded images cannot be left out of the archive", archivePath)
+		return nil
+	}
+
+	excluded := map[string][]string{} // repository -> excluded tags
+	for _, row := range rows {
+		if row.Export || row.Error != "" || row.Ignored != "" {
+			continue
+		}
+		ref, err := registry.ParseNormalized(row.Image)
+		if err != nil || ref.Tag == "" {
+			continue
+		}
+		repo := ref.MirrorName(row.Target)
+		excluded[repo] = append(excluded[repo], ref.Tag)
+	}
+
+	members := []string{}
+	for repo, tags := range excluded {
+		member := path.Join(".", STORAGE_REPOSITORIES, repo)
+		kept, err := keptTags(filepath.Join(repositories, repo), tags)
+		if err != nil {
+			log.Warn.Printf("Cannot read the tags of %s: %v", repo, err)
+			continue
+		}
+		if len(kept) == 0 {
+			for _, dir := range repositoryMembers {
+				members = append(members, path.Join(member, dir))
+			}
+			continue
+		}
+		for _, tag := range tags {
+			members = append(members, path.Join(member, "_manifests/tags", tag))
+		}
+		members = append(members, unreferencedMembers(archivePath, repo, kept)...)
+	}
+	if len(members) > 0 {
+		members = append(members, unlinkedBlobs(archivePath, members)...)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Blob members that no revision or layer link of the archive references, links under the
+// excluded members do not count. Nothing is left out when the storage cannot be read.
+func unlinkedBlobs(archivePath string, excluded []string) []string {
+	linked := map[string]bool{}
+	repositories := filepath.Join(archivePath, STORAGE_REPOSITORIES)
+	err := filepath.Walk(repositories, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(repositories, file)
+		if err != nil {
+			return err
+		}
+		member := path.Join(".", STORAGE_REPOSITORIES, filepath.ToSlash(rel))
+		if isExcluded(member, excluded) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// <repo>/_layers/<alg>/<hex>/link, <repo>/_manifests/revisions/<alg>/<hex>/link
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if info.IsDir() || info.Name() != "link" || len(parts) < 5 {
+			return nil
+		}
+		n := len(parts)
+		if parts[n-4] == "_layers" || (parts[n-5] == "_manifests" && parts[n-4] == "revisions") {
+			linked[parts[n-3]+":"+parts[n-2]] = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn.Printf("Cannot read the repository links, blobs of excluded images stay in the archive: %v", err)
+		return nil
+	}
+
+	members := []string{}
+	blobs := filepath.Join(archivePath, STORAGE_BLOBS)
+	algorithms, err := ioutil.ReadDir(blobs)
+	if err != nil {
+		log.Warn.Printf("Cannot read the blob store, blobs of excluded images stay in the archive: %v", err)
+		return nil
+	}
+	for _, algorithm := range algorithms {
+		prefixes, err := ioutil.ReadDir(filepath.Join(blobs, algorithm.Name()))
+		if err != nil {
+			continue
+		}
+		for _, prefix := range prefixes {
+			entries, err := ioutil.ReadDir(filepath.Join(blobs, algorithm.Name(), prefix.Name()))
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if !linked[algorithm.Name()+":"+entry.Name()] {
+					members = append(members, path.Join(".", STORAGE_BLOBS, algorithm.Name(), prefix.Name(), entry.Name()))
+				}
+			}
+		}
+	}
+	return members
+}
+
+// Whether the member is one of the excluded members or inside one
+func isExcluded(member string, excluded []string) bool {
+	for _, exclude := range excluded {
+		if member == exclude || strings.HasPrefix(member, exclude+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Tags of the repository in the storage other than the excluded tags
+func keptTags(repoPath string, excluded []string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(repoPath, "_manifests/tags"))
+	if err != nil {
+		return nil, err
+	}
+	kept := []string{}
+	for _, entry := range entries {
+		found := false
+		for _, tag := range excluded {
+			if entry.Name() == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kept = append(kept, entry.Name())
+		}
+	}
+	return kept, nil
+}
+
+// Revision and layer links of the repository that no kept tag references
+func unreferencedMembers(archivePath, repo string, kept []string) []string {
+	repoPath := filepath.Join(archivePath, STORAGE_REPOSITORIES, repo)
+	revisions, layers, err := referencedDigests(archivePath, repoPath, kept)
+	if err != nil {
+		log.Warn.Printf("Cannot read the manifests of %s, its excluded images stay pullable by digest: %v", repo, err)
+		return nil
+	}
+	members := []string{}
+	for dir, referenced := range map[string]map[string]bool{"_manifests/revisions": revisions, "_layers": layers} {
+		algorithms, err := ioutil.ReadDir(filepath.Join(repoPath, dir))
+		if err != nil {
+			continue
+		}
+		for _, algorithm := range algorithms {
+			entries, err := ioutil.ReadDir(filepath.Join(repoPath, dir, algorithm.Name()))
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if !referenced[algorithm.Name()+":"+entry.Name()] {
+					members = append(members, path.Join(".", STORAGE_REPOSITORIES, repo, dir, algorithm.Name(), entry.Name()))
+				}
+			}
+		}
+	}
+	return members
+}
+
+// Manifests and blobs referenced by the tags, manifests of a list included
+func referencedDigests(archivePath, repoPath string, tags []string) (map[string]bool, map[string]bool, error) {
+	revisions, layers := map[string]bool{}, map[string]bool{}
+	queue := []string{}
+	for _, tag := range tags {
+		link, err := ioutil.ReadFile(filepath.Join(repoPath, "_manifests/tags", tag, "current/link"))
+		if err != nil {
+			return nil, nil, err
+		}
+		queue = append(queue, strings.TrimSpace(string(link)))
+	}
+	for len(queue) > 0 {
+		digest := queue[0]
+		queue = queue[1:]
+		if revisions[digest] {
+			continue
+		}
+		revisions[digest] = true
+		data, err := readBlob(archivePath, digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		manifest := &client.Manifest{Body: data}
+		children, err := manifest.Children()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, child := range children {
+			queue = append(queue, child.Digest)
+		}
+		blobs, err := manifest.Blobs()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, blob := range blobs {
+			layers[blob.Digest] = true
+		}
+	}
+	return revisions, layers, nil
+}
+
+// Content of a blob in the shared blob store ("sha256:abcd..." -> blobs/sha256/ab/abcd.../data)
+func readBlob(archivePath, digest string) ([]byte, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || len(parts[1]) < 2 || strings.ContainsAny(digest, "/\\.") {
+		return nil, fmt.Errorf("invalid digest %q", digest)
+	}
+	return ioutil.ReadFile(filepath.Join(archivePath, STORAGE_BLOBS, parts[0], parts[1][:2], parts[1], "data"))
+}
+
+// tar of the registry storage, excluded members left out
+func (h *Handler) archiveStorage(tarName string, excludes []string) (string, error) {
+	tarArgs := []string{"--create", "--gzip", "--file=" + tarName}
+	for _, exclude := range excludes {
+		tarArgs = append(tarArgs, "--exclude="+exclude)
+	}
+	tarArgs = append(tarArgs, "-C", h.ServerConfig.RegistryConfig.ArchivePath, ".")
+	tarCmd := command.New("tar", tarArgs...)
+	tarCmd.Timeout = EXPORT_TIMEOUT
+	log.Info.Println(tarCmd)
+	return command.Output(context.Background(), h.executor, tarCmd)
+}
+
+// tar.gz of an OCI image layout holding only the exported images, read from the mirror registry
+func (h *Handler) archiveImages(tarName string, rows []gsheet.Row) (*native.ArchiveStats, error) {
+	images := []native.ArchiveImage{}
+	for _, row := range rows {
+		if !row.Export || row.Error != "" || row.Ignored != "" {
+			continue
+		}
+		ref, err := registry.ParseNormalized(row.Image)
+		if err != nil {
+			continue
+		}
+		// mirrored under the tag when there is one
+		mirrorRef := ref.Tag
+		if mirrorRef == "" {
+			mirrorRef = ref.Digest
+		}
+		images = append(images, native.ArchiveImage{Image: row.Image, Name: ref.MirrorName(row.Target), Ref: mirrorRef})
+	}
+
+	mirror, err := h.newNative()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(tarName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	log.Info.Printf("Archiving %d images into %s", len(images), tarName)
+	stats, err := mirror.WriteArchive(gz, images)
+	if err != nil {
+		return stats, err
+	}
+	if err := gz.Close(); err != nil {
+		return stats, err
+	}
+	return stats, file.Close()
+}
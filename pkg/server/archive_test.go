@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	client "github.com/gsheet-exporter/internal/registry"
+	"github.com/gsheet-exporter/pkg/gsheet"
+)
+
+// Registry storage written the way the distribution filesystem driver lays it out
+type testStorage struct {
+	t    *testing.T
+	root string
+}
+
+func (storage testStorage) write(name, content string) {
+	file := filepath.Join(storage.root, name)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		storage.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		storage.t.Fatal(err)
+	}
+}
+
+func (storage testStorage) blob(content []byte) string {
+	hex := fmt.Sprintf("%x", sha256.Sum256(content))
+	storage.write(filepath.Join(STORAGE_BLOBS, "sha256", hex[:2], hex, "data"), string(content))
+	return "sha256:" + hex
+}
+
+func (storage testStorage) link(repo, dir, digest string) {
+	storage.write(filepath.Join(STORAGE_REPOSITORIES, repo, dir, strings.Replace(digest, ":", "/", 1), "link"), digest)
+}
+
+// Image with one layer pushed into the repository, the manifest digest is returned
+func (storage testStorage) image(repo, layer string) string {
+	layerDigest := storage.blob([]byte(layer))
+	storage.link(repo, "_layers", layerDigest)
+	body, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     client.MEDIA_TYPE_DOCKER_V2,
+		"layers":        []client.Descriptor{{Digest: layerDigest}},
+	})
+	digest := storage.blob(body)
+	storage.link(repo, "_manifests/revisions", digest)
+	return digest
+}
+
+func (storage testStorage) tag(repo, tag, digest string) {
+	storage.write(filepath.Join(STORAGE_REPOSITORIES, repo, "_manifests/tags", tag, "current/link"), digest)
+	storage.link(repo, filepath.Join("_manifests/tags", tag, "index"), digest)
+}
+
+func TestExcludeMembers(t *testing.T) {
+	storage := testStorage{t: t, root: t.TempDir()}
+	// app:1 is a list of two images, app:2 an image of its own
+	amd64, arm64 := storage.image("app", "amd64 layer"), storage.image("app", "arm64 layer")
+	list, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     client.MEDIA_TYPE_DOCKER_LIST,
+		"manifests":     []client.Descriptor{{Digest: amd64}, {Digest: arm64}},
+	})
+	listDigest := storage.blob(list)
+	storage.link("app", "_manifests/revisions", listDigest)
+	storage.tag("app", "1", listDigest)
+	excludedImage := storage.image("app", "excluded layer")
+	storage.tag("app", "2", excludedImage)
+	// org/tool is excluded, the nested org/tool/sub exported with the same image
+	storage.tag("org/tool", "1", storage.image("org/tool", "sub layer"))
+	storage.tag("org/tool/sub", "1", storage.image("org/tool/sub", "sub layer"))
+	// team/db is excluded, its blobs are linked by no other repository
+	dbImage := storage.image("team/db", "db layer")
+	storage.tag("team/db", "1", dbImage)
+
+	rows := []gsheet.Row{
+		row("app:1", true),
+		row("app:2", false),
+		row("org/tool:1", false),
+		row("org/tool/sub:1", true),
+		row("team/db:1", false),
+	}
+	members := excludeMembers(storage.root, rows)
+
+	repo := STORAGE_REPOSITORIES + "/"
+	blob := func(digest string) string {
+		hex := strings.TrimPrefix(digest, "sha256:")
+		return STORAGE_BLOBS + "/sha256/" + hex[:2] + "/" + hex
+	}
+	want := []string{
+		blob(storage.blob([]byte("db layer"))),
+		blob(dbImage),
+		blob(storage.blob([]byte("excluded layer"))),
+		blob(excludedImage),
+		repo + "app/_layers/sha256/" + strings.TrimPrefix(storage.blob([]byte("excluded layer")), "sha256:"),
+		repo + "app/_manifests/revisions/sha256/" + strings.TrimPrefix(excludedImage, "sha256:"),
+		repo + "app/_manifests/tags/2",
+		repo + "org/tool/_layers",
+		repo + "org/tool/_manifests",
+		repo + "org/tool/_uploads",
+		repo + "team/db/_layers",
+		repo + "team/db/_manifests",
+		repo + "team/db/_uploads",
+	}
+	sort.Strings(want)
+	if strings.Join(members, "\n") != strings.Join(want, "\n") {
+		t.Errorf("excluded members:\n%s\nwant:\n%s", strings.Join(members, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Check the delete list of the plan against the safety guards.
+// Protected images are dropped from the list, and the whole list is blocked when
+// the sheet is empty or the threshold is exceeded without the confirmation token.
+func (c SyncConfig) guardDelete(plan *SyncPlan, registryTotal int, confirm string) {
+	deleteImageList := []string{}
+	for _, image := range plan.Delete {
+		if c.isProtected(image) {
+			log.Info.Printf("[%s] Protected, skip delete", image)
+			plan.Protected = append(plan.Protected, image)
+			continue
+		}
+		deleteImageList = append(deleteImageList, image)
+	}
+	plan.Delete = deleteImageList
+
+	if len(plan.Delete) == 0 {
+		return
+	}
+	// a transiently empty sheet or a wrong range would wipe the whole mirror
+	if len(plan.Images) == 0 {
+		plan.blockDelete("google sheet returned zero images")
+		return
+	}
+	if !c.overThreshold(len(plan.Delete), registryTotal) {
+		return
+	}
+	if c.ConfirmToken != "" && confirm == c.ConfirmToken {
+		log.Info.Printf("Delete %d images over the threshold, confirmed", len(plan.Delete))
+		return
+	}
+	plan.blockDelete(fmt.Sprintf("%d of %d registry images exceeds the delete threshold (max %d, %.1f%%), confirmation required",
+		len(plan.Delete), registryTotal, c.MaxDelete, c.MaxDeletePercent))
+}
+
+func (c SyncConfig) overThreshold(deletes, total int) bool {
+	if c.MaxDelete > 0 && deletes > c.MaxDelete {
+		return true
+	}
+	if c.MaxDeletePercent > 0 && total > 0 && float64(deletes)*100/float64(total) > c.MaxDeletePercent {
+		return true
+	}
+	return false
+}
+
+// Match the repository (image without tag) against protected globs (path.Match syntax)
+func (c SyncConfig) isProtected(image string) bool {
+	repo := image
+	if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+		repo = image[:idx]
+	}
+	for _, pattern := range c.ProtectedRepos {
+		if matched, _ := path.Match(pattern, repo); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (plan *SyncPlan) blockDelete(reason string) {
+	log.Error.Printf("Delete blocked: %s", reason)
+	plan.DeleteBlocked = reason
+	plan.Blocked = plan.Delete
+	plan.Delete = []string{}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// job status
+const (
+	JOB_PENDING   = "pending"
+	JOB_RUNNING   = "running"
+	JOB_SUCCEEDED = "succeeded"
+	JOB_PARTIAL   = "partial" // finished with some images failed (207)
+	JOB_FAILED    = "failed"
+
+	MAX_JOBS = 100 // finished jobs kept for GET /jobs
+)
+
+// Background sync/export run
+type Job struct {
+	mu sync.Mutex
+
+	ID         string        `json:"id"`
+	Kind       string        `json:"kind"`
+	Status     string        `json:"status"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	StartedAt  *time.Time    `json:"startedAt,omitempty"`
+	FinishedAt *time.Time    `json:"finishedAt,omitempty"`
+	Progress   Progress      `json:"progress"`
+	Log        []ImageResult `json:"log,omitempty"`
+	Result     interface{}   `json:"result,omitempty"`
+}
+
+type Progress struct {
+	Total  int `json:"total"`
+	Done   int `json:"done"`
+	Failed int `json:"failed"`
+}
+
+// Keep recent jobs in memory
+type JobManager struct {
+	mu    sync.Mutex
+	seq   int
+	jobs  map[string]*Job
+	order []string
+}
+
+// job body returns the final report of the run
+type jobFunc func(job *Job) statusReport
+
+type statusReport interface {
+	report
+	status() int
+}
+
+func NewJobManager() *JobManager {
+	return &JobManager{
+		jobs: map[string]*Job{},
+	}
+}
+
+// Start the run in background and return the job immediately
+func (m *JobManager) Submit(kind string, run jobFunc) *Job {
+	m.mu.Lock()
+	m.seq++
+	now := time.Now()
+	job := &Job{
+		ID:        fmt.Sprintf("%s-%s-%d", kind, now.Format(YYMMDDhhmmss), m.seq),
+		Kind:      kind,
+		Status:    JOB_PENDING,
+		CreatedAt: now,
+		Log:       []ImageResult{},
+	}
+	m.jobs[job.ID] = job
+	m.order = append(m.order, job.ID)
+	m.evict()
+	m.mu.Unlock()
+
+	go func() {
+		job.start()
+		r := run(job)
+		job.finish(r)
+	}()
+	return job
+}
+
+func (m *JobManager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// Recent jobs, newest first, without their logs and results
+func (m *JobManager) List() []*Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := []*Job{}
+	for i := len(m.order) - 1; i >= 0; i-- {
+		job := m.jobs[m.order[i]].Snapshot()
+		job.Log = nil
+		job.Result = nil
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// drop the oldest finished jobs over MAX_JOBS
+func (m *JobManager) evict() {
+	for len(m.order) > MAX_JOBS {
+		evicted := false
+		for idx, id := range m.order {
+			if m.jobs[id].finished() {
+				delete(m.jobs, id)
+				m.order = append(m.order[:idx], m.order[idx+1:]...)
+				evicted = true
+				break
+			}
+		}
+		if !evicted {
+			return
+		}
+	}
+}
+
+// Copy of the job safe to encode while it is running
+func (job *Job) Snapshot() *Job {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return &Job{
+		ID:         job.ID,
+		Kind:       job.Kind,
+		Status:     job.Status,
+		CreatedAt:  job.CreatedAt,
+		StartedAt:  job.StartedAt,
+		FinishedAt: job.FinishedAt,
+		Progress:   job.Progress,
+		Log:        append([]ImageResult{}, job.Log...),
+		Result:     job.Result,
+	}
+}
+
+func (job *Job) start() {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	now := time.Now()
+	job.Status = JOB_RUNNING
+	job.StartedAt = &now
+}
+
+func (job *Job) finish(r statusReport) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Result = r
+	switch status := r.status(); {
+	case status == http.StatusMultiStatus:
+		job.Status = JOB_PARTIAL
+	case status >= 300:
+		job.Status = JOB_FAILED
+	default:
+		job.Status = JOB_SUCCEEDED
+	}
+	log.Info.Printf("[job %s] %s", job.ID, job.Status)
+}
+
+func (job *Job) finished() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.Status == JOB_SUCCEEDED || job.Status == JOB_PARTIAL || job.Status == JOB_FAILED
+}
+
+// Add the number of operations the run will do, a nil job (synchronous run) is ignored
+func (job *Job) addTotal(n int) {
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Progress.Total += n
+}
+
+// Record the result of one operation
+func (job *Job) record(result ImageResult) {
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Progress.Done++
+	if result.Status == STATUS_FAILED {
+		job.Progress.Failed++
+	}
+	job.Log = append(job.Log, result)
+}
@@ -0,0 +1,22 @@
+package server
+
+import "testing"
+
+func TestJobFinishStatus(t *testing.T) {
+	tests := []struct {
+		report statusReport
+		want   string
+	}{
+		{&SyncReport{Summary: map[string]int{STATUS_COPIED: 2}}, JOB_SUCCEEDED},
+		{&SyncReport{Summary: map[string]int{STATUS_COPIED: 1, STATUS_FAILED: 1}}, JOB_PARTIAL},
+		{&SyncReport{Error: "cannot read the sheet"}, JOB_FAILED},
+		{&ExportReport{Steps: []StepResult{{Ok: true}, {Ok: false}}}, JOB_PARTIAL},
+	}
+	for _, test := range tests {
+		job := &Job{ID: "1", Status: JOB_RUNNING}
+		job.finish(test.report)
+		if job.Status != test.want || !job.finished() {
+			t.Errorf("job of a %d report is %s, want %s", test.report.status(), job.Status, test.want)
+		}
+	}
+}
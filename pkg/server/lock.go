@@ -0,0 +1,26 @@
+package server
+
+import "sync"
+
+// Only one run changing the registry or the release sheet (sync, pushv1, export) at a time
+type runLock struct {
+	mu    sync.Mutex
+	owner string
+}
+
+// Take the lock without waiting, the current owner is returned when busy
+func (l *runLock) tryLock(owner string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.owner != "" {
+		return l.owner, false
+	}
+	l.owner = owner
+	return owner, true
+}
+
+func (l *runLock) unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.owner = ""
+}
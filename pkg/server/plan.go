@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/gsheet-exporter/pkg/gsheet"
+	"github.com/gsheet-exporter/pkg/registry"
+	"github.com/gsheet-exporter/pkg/skopeo"
+)
+
+// What a sync would do, computed without invoking skopeo
+type SyncPlan struct {
+	SheetsRange string   `json:"sheetsRange"`
+	Images      []string `json:"images"`
+	Except      []string `json:"except"`
+	Copy        []string `json:"copy"`
+	Delete      []string `json:"delete"`
+	Failed      []string `json:"failed"`
+
+	// manifest list handling of each image ("system", "all", "linux/arm64")
+	CopyModes map[string]string `json:"copyModes,omitempty"`
+	// mirror repository of images with a target column (exported or excluded)
+	Targets map[string]string `json:"targets,omitempty"`
+	// rows failing validation, neither copied nor exported
+	Invalid []gsheet.Row `json:"invalid,omitempty"`
+	// images listed by several rows and how they were resolved
+	Diagnostics []gsheet.Diagnostic `json:"diagnostics,omitempty"`
+	// every row read, their status is written back after the sync
+	Rows []gsheet.Row `json:"-"`
+
+	// deletion safety guards
+	Protected     []string `json:"protected,omitempty"`
+	Blocked       []string `json:"blocked,omitempty"`
+	DeleteBlocked string   `json:"deleteBlocked,omitempty"`
+}
+
+// Options of one sync run
+type syncOptions struct {
+	SheetsRange string // target sheet ranges ("?range=" overrides the config)
+	Confirm     string // token allowing deletions over the threshold
+	DryRun      bool
+}
+
+// Read google sheet, then find images to copy into and delete from the registry
+func (h *Handler) plan(opts syncOptions) (*SyncPlan, error) {
+	// 1. create instance
+	gsheetInstance, err := h.targetSheet(opts.SheetsRange)
+	if err != nil {
+		return nil, err
+	}
+	registryInstance, err := h.mirror()
+	if err != nil {
+		return nil, err
+	}
+	// 2. get all google sheet image list
+	rows, diagnostics, err := gsheetInstance.GetRows()
+	if err != nil {
+		return nil, err
+	}
+	images, except, invalid := []string{}, []string{}, []gsheet.Row{}
+	targets := map[string]string{}
+	for _, row := range rows {
+		switch {
+		case row.Ignored != "":
+			continue
+		case row.Error != "":
+			invalid = append(invalid, row)
+		case row.Export:
+			images = append(images, row.Image)
+			if row.Target != "" {
+				targets[row.Image] = row.Target
+			}
+		default:
+			except = append(except, row.Image)
+			if row.Target != "" {
+				targets[row.Image] = row.Target
+			}
+		}
+	}
+	plan := &SyncPlan{
+		SheetsRange: opts.SheetsRange,
+		Images:      images,
+		Except:      except,
+		CopyModes:   h.copyModes(rows),
+		Targets:     targets,
+		Invalid:     invalid,
+		Diagnostics: diagnostics,
+		Rows:        rows,
+	}
+	// 3. images not exists in registry
+	mirror := plan.mirrorOptions()
+	plan.Copy, plan.Failed = registryInstance.FindCopyImageList(images, mirror)
+	// 4. images stored in the registry but not in the Google Sheets list.
+	deleteImageList, registryTotal := registryInstance.FindDeleteImageList(keptImages(rows))
+	plan.Delete = deleteImageList
+	// 5. protect the mirror from unexpected mass deletions
+	h.ServerConfig.SyncConfig.guardDelete(plan, registryTotal, opts.Confirm)
+	return plan, nil
+}
+
+// Mirrored "repository:tag" the sync must not delete, each row under its own target.
+// Excluded images stay in the registry (only left out of the export), a row with an invalid cell
+// (ex. unrecognized export value, typo in the platform, conflicting target) keeps its mirrored
+// image until the row is fixed: an invalid row is not a row deleted from the sheet.
+func keptImages(rows []gsheet.Row) []string {
+	keep := []string{}
+	for _, row := range rows {
+		if row.Ignored != "" {
+			continue
+		}
+		ref, err := registry.ParseNormalized(row.Image)
+		if err != nil {
+			continue
+		}
+		if tag := ref.MirrorTag(row.Target); tag != "" {
+			keep = append(keep, tag)
+		}
+		// an invalid target cannot hold a copy, the familiar name may
+		if row.Error != "" && row.Target != "" {
+			keep = append(keep, ref.MirrorTag(""))
+		}
+	}
+	return keep
+}
+
+// How every exported and excluded image is stored in the mirror
+func (plan *SyncPlan) mirrorOptions() map[string]registry.MirrorOptions {
+	mirror := map[string]registry.MirrorOptions{}
+	for _, image := range append(append([]string{}, plan.Images...), plan.Except...) {
+		mode := plan.CopyModes[image]
+		opts := registry.MirrorOptions{
+			MultiArch: mode == skopeo.COPY_ALL,
+			Target:    plan.Targets[image],
+		}
+		if skopeo.IsPlatform(mode) {
+			opts.Platform = mode
+		}
+		mirror[image] = opts
+	}
+	return mirror
+}
+
+// Target sheet reader with the configured columns
+func (h *Handler) targetSheet(sheetsRange string) (Sheet, error) {
+	return h.sheet(SheetSpec{
+		SpreadsheetId: h.ServerConfig.GoogleConfig.TargetSheets,
+		ReadRange:     sheetsRange,
+		Columns:       h.ServerConfig.GoogleConfig.SheetColumns,
+		ExportFlag:    h.ServerConfig.GoogleConfig.ExportFlag,
+		ConflictRule:  h.ServerConfig.GoogleConfig.ConflictRule,
+	})
+}
+
+// Copy mode of every exported image, the platform column wins over the configured mode
+func (h *Handler) copyModes(rows []gsheet.Row) map[string]string {
+	modes := map[string]string{}
+	for _, row := range rows {
+		if !row.Export || row.Error != "" || row.Ignored != "" {
+			continue
+		}
+		mode := h.ServerConfig.SyncConfig.CopyMode
+		if mode == "" {
+			mode = skopeo.COPY_SYSTEM
+		}
+		// an invalid platform cell fails the row validation
+		if row.Platform != "" {
+			mode, _ = skopeo.ParseCopyMode(row.Platform)
+		}
+		modes[row.Image] = mode
+	}
+	return modes
+}
+
+func writePlan(w io.Writer, plan *SyncPlan) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plan)
+}
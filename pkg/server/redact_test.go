@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gsheet-exporter/pkg/logger"
+)
+
+const testSecret = `scp&<p4ss>"w\rd`
+
+func TestRedactJSONResponse(t *testing.T) {
+	logger.AddSecret(testSecret)
+	handler := redact(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		report := &ExportReport{Steps: []StepResult{{Step: "Uploading ...", Output: "Permission denied, password " + testSecret}}}
+		writeJSON(w, http.StatusMultiStatus, report)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/export", nil))
+	if rec.Code != http.StatusMultiStatus {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusMultiStatus)
+	}
+	assertNoSecret(t, rec.Body.String())
+	if !strings.Contains(rec.Body.String(), logger.MASK) {
+		t.Errorf("secret is not masked: %s", rec.Body.String())
+	}
+}
+
+func TestRedactSplitWrites(t *testing.T) {
+	logger.AddSecret(testSecret)
+	half := len(testSecret) / 2
+	handler := redact(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("output: " + testSecret[:half]))
+		w.Write([]byte(testSecret[half:] + "\n"))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sync", nil))
+	assertNoSecret(t, rec.Body.String())
+	if got, want := rec.Body.String(), "output: "+logger.MASK+"\n"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func assertNoSecret(t *testing.T, body string) {
+	t.Helper()
+	for _, part := range []string{testSecret, `scp\u0026\u003cp4ss\u003e\"w\\rd`} {
+		if strings.Contains(body, part) {
+			t.Errorf("response contains the secret %q:\n%s", part, body)
+		}
+	}
+}
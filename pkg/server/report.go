@@ -0,0 +1,316 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// per-image result status
+const (
+	STATUS_COPIED  = "copied"
+	STATUS_PRESENT = "present" // already in the registry
+	STATUS_PUSHED  = "pushed"
+	STATUS_DELETED = "deleted"
+	STATUS_SKIPPED = "skipped"
+	STATUS_FAILED  = "failed"
+	STATUS_DONE    = "done" // export step
+)
+
+// row status written back to the target sheet
+const (
+	ROW_SYNCED   = "synced"
+	ROW_EXCLUDED = "excluded" // export is false
+)
+
+// Report rendered as text (default) or json (Accept: application/json)
+type report interface {
+	Text(w io.Writer)
+}
+
+type ImageResult struct {
+	Image    string `json:"image"`
+	Status   string `json:"status"`
+	Output   string `json:"output,omitempty"`   // command output or skip reason
+	Attempts int    `json:"attempts,omitempty"` // skopeo runs including retries
+	Mode     string `json:"mode,omitempty"`     // copy mode of a manifest list ("system", "all", "linux/arm64")
+}
+
+type HealthReport struct {
+	Registry string `json:"registry"`
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error,omitempty"`
+}
+
+type SyncReport struct {
+	Error   string         `json:"error,omitempty"`
+	DryRun  bool           `json:"dryRun"`
+	Plan    *SyncPlan      `json:"plan,omitempty"`
+	Copy    []ImageResult  `json:"copy"`
+	Delete  []ImageResult  `json:"delete"`
+	Summary map[string]int `json:"summary"`
+}
+
+type PushReport struct {
+	Error   string         `json:"error,omitempty"`
+	Push    []ImageResult  `json:"push"`
+	Summary map[string]int `json:"summary"`
+}
+
+type ExportReport struct {
+	Error        string            `json:"error,omitempty"`
+	Archive      string            `json:"archive,omitempty"`
+	Steps        []StepResult      `json:"steps"`
+	ReleaseSheet string            `json:"releaseSheet,omitempty"`
+	Images       []string          `json:"images"`
+	CopyModes    map[string]string `json:"copyModes,omitempty"`
+	Format       string            `json:"format,omitempty"`   // ARCHIVE_STORAGE or ARCHIVE_OCI
+	Excluded     []string          `json:"excluded,omitempty"` // archive members left out (excluded images)
+	Skipped      map[string]string `json:"skipped,omitempty"`  // exported images not archived -> reason
+}
+
+type StepResult struct {
+	Step   string `json:"step"`
+	Ok     bool   `json:"ok"`
+	Output string `json:"output,omitempty"`
+}
+
+// "/" runs every task, reports are collected into one document
+type ControllerReport struct {
+	Health *HealthReport `json:"health,omitempty"`
+	Sync   *SyncReport   `json:"sync,omitempty"`
+	PushV1 *PushReport   `json:"pushv1,omitempty"`
+	Export *ExportReport `json:"export,omitempty"`
+}
+
+func wantsJSON(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+func writeReport(w http.ResponseWriter, req *http.Request, status int, r report) {
+	if wantsJSON(req) {
+		writeJSON(w, status, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	r.Text(w)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Error.Printf("Cannot encode response: %v", err)
+	}
+}
+
+func summarize(results ...[]ImageResult) map[string]int {
+	summary := map[string]int{}
+	for _, list := range results {
+		for _, result := range list {
+			summary[result.Status]++
+		}
+	}
+	return summary
+}
+
+func (r *HealthReport) Text(w io.Writer) {
+	if r.Healthy {
+		fmt.Fprintf(w, "Registry Server [%s] 200 OK!\n", r.Registry)
+	} else if r.Error != "" {
+		fmt.Fprintln(w, "Registry Server Fail:", r.Error)
+	} else {
+		fmt.Fprintln(w, "Registry Server Fail")
+	}
+}
+
+func (r *HealthReport) status() int {
+	if r.Healthy {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+func (r *SyncReport) Text(w io.Writer) {
+	if r.Error != "" {
+		fmt.Fprintln(w, r.Error)
+		return
+	}
+	if r.DryRun {
+		writePlan(w, r.Plan)
+		return
+	}
+	fmt.Fprintln(w, "Copy Image List")
+	idx := 0
+	for _, result := range r.Copy {
+		if result.Status == STATUS_COPIED {
+			idx++
+			fmt.Fprintf(w, "[%d] %s (%s)\n", idx, result.Image, result.Mode)
+		}
+	}
+	failed := []ImageResult{}
+	for _, result := range r.Copy {
+		if result.Status == STATUS_FAILED {
+			failed = append(failed, result)
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintln(w, "List of images that failed to find and copy")
+		for idx, result := range failed {
+			fmt.Fprintf(w, "[%d] %s (attempts: %d)\n", idx+1, result.Image, result.Attempts)
+			if result.Output != "" {
+				fmt.Fprintln(w, strings.TrimSpace(result.Output))
+			}
+		}
+	}
+	if r.Plan != nil && len(r.Plan.Diagnostics) > 0 {
+		fmt.Fprintln(w, "Images listed by several rows")
+		for idx, diagnostic := range r.Plan.Diagnostics {
+			fmt.Fprintf(w, "[%d] %s %s: %s -> %s\n", idx+1, strings.ToUpper(diagnostic.Kind), diagnostic.Image, strings.Join(diagnostic.Rows, ", "), diagnostic.Result)
+		}
+	}
+	if r.Plan != nil && r.Plan.DeleteBlocked != "" {
+		fmt.Fprintf(w, "Delete blocked: %s\n", r.Plan.DeleteBlocked)
+	}
+	fmt.Fprintln(w, "Delete Image List")
+	for idx, result := range r.Delete {
+		switch result.Status {
+		case STATUS_DELETED:
+			fmt.Fprintf(w, "[%d] %s\n", idx+1, result.Image)
+		case STATUS_FAILED:
+			fmt.Fprintf(w, "[FAIL][%d] %s:%s\n", idx+1, result.Image, strings.TrimSpace(result.Output))
+		default:
+			fmt.Fprintf(w, "[%s][%d] %s %s\n", strings.ToUpper(result.Status), idx+1, result.Image, result.Output)
+		}
+	}
+}
+
+func (r *SyncReport) status() int {
+	switch {
+	case r.Error != "":
+		return http.StatusBadGateway
+	case r.Summary[STATUS_FAILED] > 0 || (r.Plan != nil && r.Plan.DeleteBlocked != ""):
+		return http.StatusMultiStatus
+	}
+	return http.StatusOK
+}
+
+func (r *PushReport) Text(w io.Writer) {
+	if r.Error != "" {
+		fmt.Fprintln(w, r.Error)
+		return
+	}
+	for _, result := range r.Push {
+		if result.Status == STATUS_PUSHED {
+			fmt.Fprintf(w, "Push Docker V1 image : %s\n", result.Image)
+		} else {
+			fmt.Fprintln(w, result.Output)
+		}
+	}
+}
+
+func (r *PushReport) status() int {
+	switch {
+	case r.Error != "":
+		return http.StatusBadGateway
+	case r.Summary[STATUS_FAILED] > 0:
+		return http.StatusMultiStatus
+	}
+	return http.StatusOK
+}
+
+// Append an export step, recorded in the job log as well
+func (r *ExportReport) step(job *Job, step StepResult) {
+	r.Steps = append(r.Steps, step)
+	result := ImageResult{Image: r.Archive, Status: STATUS_DONE, Output: step.Step}
+	if !step.Ok {
+		result.Status = STATUS_FAILED
+		result.Output = step.Step + "\n" + step.Output
+	}
+	job.record(result)
+}
+
+func (r *ExportReport) Text(w io.Writer) {
+	for _, step := range r.Steps {
+		fmt.Fprintln(w, step.Step)
+		if !step.Ok && step.Output != "" {
+			fmt.Fprintln(w, strings.TrimSpace(step.Output))
+		}
+	}
+	if len(r.Excluded) > 0 {
+		fmt.Fprintln(w, "Excluded from the archive")
+		for idx, member := range r.Excluded {
+			fmt.Fprintf(w, "[%d] %s\n", idx+1, member)
+		}
+	}
+	if len(r.Skipped) > 0 {
+		fmt.Fprintln(w, "Not archived")
+		images := []string{}
+		for image := range r.Skipped {
+			images = append(images, image)
+		}
+		sort.Strings(images)
+		for idx, image := range images {
+			fmt.Fprintf(w, "[%d] %s: %s\n", idx+1, image, r.Skipped[image])
+		}
+	}
+	if r.Error != "" {
+		fmt.Fprintln(w, r.Error)
+	}
+}
+
+func (r *ExportReport) status() int {
+	if r.Error != "" {
+		return http.StatusBadGateway
+	}
+	for _, step := range r.Steps {
+		if !step.Ok {
+			return http.StatusMultiStatus
+		}
+	}
+	return http.StatusOK
+}
+
+func (r *ControllerReport) Text(w io.Writer) {
+	if r.Health != nil {
+		r.Health.Text(w)
+	}
+	if r.Sync != nil {
+		r.Sync.Text(w)
+	}
+	if r.PushV1 != nil {
+		r.PushV1.Text(w)
+	}
+	if r.Export != nil {
+		r.Export.Text(w)
+	}
+}
+
+// the worst status of the collected reports
+func (r *ControllerReport) status() int {
+	status := http.StatusOK
+	worst := func(s int) {
+		if s > status {
+			status = s
+		}
+	}
+	if r.Health != nil {
+		worst(r.Health.status())
+	}
+	if r.Sync != nil {
+		worst(r.Sync.status())
+	}
+	if r.PushV1 != nil {
+		worst(r.PushV1.status())
+	}
+	if r.Export != nil {
+		worst(r.Export.status())
+	}
+	return status
+}
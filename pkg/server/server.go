@@ -1,15 +1,23 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gsheet-exporter/internal/command"
 	"github.com/gsheet-exporter/pkg/gsheet"
 	"github.com/gsheet-exporter/pkg/logger"
+	"github.com/gsheet-exporter/pkg/native"
 	"github.com/gsheet-exporter/pkg/registry"
 	"github.com/gsheet-exporter/pkg/skopeo"
+	"github.com/gsheet-exporter/pkg/worker"
 )
 
 type Server struct {
@@ -19,50 +27,121 @@ type Server struct {
 
 type Handler struct {
 	ServerConfig ServerConfig
+
+	jobs     *JobManager
+	lock     *runLock
+	executor command.Executor // docker copy & export commands
+	skopeo   *skopeo.Skopeo
+	pool     *worker.Pool // copy & delete workers, rate limits hold across runs
+	checks   *worker.Pool // rate limits of upstream digest checks, apart from the copy budget
+
+	// sheet & mirror sources, the Google Sheets API and the registry client when nil
+	openSheet  SheetOpener
+	openMirror MirrorOpener
+}
+
+// Copies images into and deletes them from the mirror registry (skopeo or native engine)
+type Copier interface {
+	Copy(image string, opts skopeo.CopyOptions) (string, string, error)
+	Delete(image string) (string, error)
+	Inspect(image string) error
 }
 
 type ServerConfig struct {
 	GoogleConfig   GoogleConfig
 	RegistryConfig RegistryConfig
 	CredConfig     CredConfig
+	SyncConfig     SyncConfig
 }
 
 type GoogleConfig struct {
-	GoogleCredentials string `required:"true"`
-	TargetSheets      string `required:"true"`
-	SheetsRange       string `required:"true"`
-	ReleaseSheets     string `required:"true"`
+	GoogleCredentials string         `required:"true"`
+	TargetSheets      string         `required:"true"`
+	SheetsRange       string         `required:"true"`
+	ReleaseSheets     string         `required:"true"`
+	SheetColumns      gsheet.Columns // row fields of SheetsRange, positional (image, export) when empty
+	ExportFlag        gsheet.ExportFlag
+	ConflictRule      string // gsheet.CONFLICT_* for an image listed by several rows
 }
 
 type RegistryConfig struct {
-	RegistryUrl string `required:"true"`
-	ArchivePath string `required:"true"`
-	ScpDest     string `required:"true"`
-	ScpPass     string `required:"true"`
+	RegistryUrl      string `required:"true"`
+	ArchivePath      string // registry storage root, required by ARCHIVE_STORAGE
+	ScpDest          string `required:"true"`
+	ScpPass          string `required:"true"`
+	RegistryCred     string
+	RegistryCaFile   string
+	RegistryInsecure bool
+	ArchiveFormat    string // ARCHIVE_OCI (default) or ARCHIVE_STORAGE
 }
 
 type CredConfig struct {
 	DockerCred string
 	QuayCred   string
 	GcrCred    string
+
+	Profiles []skopeo.Profile // user-defined source registry credentials
+	AuthFile string           // docker config.json / auth.json keyed by registry host
+}
+
+// Safety guards of registry reconciliation (zero value disables a threshold)
+type SyncConfig struct {
+	MaxDelete        int      // maximum images deleted by a sync without confirmation
+	MaxDeletePercent float64  // maximum percentage of registry images deleted without confirmation
+	ProtectedRepos   []string // repository globs never deleted (ex. "library/*")
+	ConfirmToken     string   // "?confirm=" value allowing deletions over the threshold
+
+	Concurrency int                    // parallel copy & delete operations
+	RateLimits  map[string]worker.Rate // per source registry (ex. "docker.io")
+	CheckLimits map[string]worker.Rate // upstream digest checks per source registry, unlimited when empty
+	Retry       skopeo.RetryPolicy     // retry of transient copy & delete failures
+
+	CheckUpstreamDigest bool // re-copy mirrored tags whose source digest changed
+
+	CopyMode string // manifest list handling of images without a platform column ("system", "all", "linux/arm64")
+
+	CopyEngine   string // ENGINE_SKOPEO or ENGINE_NATIVE
+	PushV1Engine string // ENGINE_DOCKER or ENGINE_NATIVE for the "unsupported" sheet
 }
 
 const (
 	YYMMDDhhmmss = "20060102-150405" // 2006-01-02 15:04:05
+
+	EXPORT_TIMEOUT = 2 * time.Hour // tar & scp of the registry storage
+
+	ENGINE_SKOPEO = "skopeo" // skopeo binary
+	ENGINE_NATIVE = "native" // registry v2 API, no binary required
+	ENGINE_DOCKER = "docker" // docker daemon pull, tag & push
+
+	ARCHIVE_STORAGE = "storage" // tar of the registry storage (ArchivePath)
+	ARCHIVE_OCI     = "oci"     // OCI image layout of the exported images, loadable by docker load
 )
 
 var (
-	tarName         string
-	imageList       []string
-	exceptImageList []string
-
 	log = logger.GetInstance()
 )
 
 func New(addr string, srvConfig ServerConfig) *Server {
 
+	skopeos := skopeo.New(srvConfig.CredConfig.DockerCred, srvConfig.CredConfig.QuayCred, srvConfig.CredConfig.GcrCred,
+		registryHost(srvConfig.RegistryConfig.RegistryUrl))
+	skopeos.DestCred = srvConfig.RegistryConfig.RegistryCred
+	skopeos.DestCAFile = srvConfig.RegistryConfig.RegistryCaFile
+	// skopeo has no scheme, a plain http mirror is reached without tls verification
+	skopeos.DestTLSVerify = !srvConfig.RegistryConfig.RegistryInsecure && !strings.HasPrefix(srvConfig.RegistryConfig.RegistryUrl, "http://")
+	skopeos.AuthFile = srvConfig.CredConfig.AuthFile
+	skopeos.ExtraProfiles = srvConfig.CredConfig.Profiles
+	skopeos.CopyMode = srvConfig.SyncConfig.CopyMode
+	skopeo.SetProfiles(skopeos)
+
 	h := Handler{
 		ServerConfig: srvConfig,
+		jobs:         NewJobManager(),
+		lock:         &runLock{},
+		executor:     command.ExecExecutor{},
+		skopeo:       skopeos,
+		pool:         worker.NewPool(srvConfig.SyncConfig.Concurrency, srvConfig.SyncConfig.RateLimits),
+		checks:       worker.NewPool(1, srvConfig.SyncConfig.CheckLimits),
 	}
 
 	srv := &Server{
@@ -82,8 +161,38 @@ func (s *Server) routes() {
 	r.HandleFunc("/sync", s.handler.sync)
 	r.HandleFunc("/push/v1", s.handler.pushv1)
 	r.HandleFunc("/export", s.handler.export) // export+write
+	r.HandleFunc("/jobs", s.handler.listJobs)
+	r.HandleFunc("/jobs/", s.handler.getJob)
 
-	s.server.Handler = r
+	s.server.Handler = redact(r)
+}
+
+// Mask secrets in every response body. The whole body is buffered first,
+// a secret split across several writes is masked as well.
+func redact(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rw := &redactResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, req)
+		if _, err := io.WriteString(w, logger.Redact(rw.body.String())); err != nil {
+			log.Error.Printf("Cannot write response: %v", err)
+		}
+	})
+}
+
+type redactResponseWriter struct {
+	http.ResponseWriter
+	body strings.Builder
+}
+
+func (w *redactResponseWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+// Run external commands (skopeo, docker, tar, scp) through the executor, ex) command.Fake in tests
+func (s *Server) WithExecutor(executor command.Executor) *Server {
+	s.handler.executor = executor
+	s.handler.skopeo.Executor = executor
+	return s
 }
 
 func (s *Server) Start() {
@@ -98,181 +207,604 @@ func (s *Server) Start() {
 	}
 }
 
+func (h *Handler) newRegistry() (*registry.Registry, error) {
+	cred, err := h.registryCred()
+	if err != nil {
+		return nil, err
+	}
+	return registry.NewRegistry(h.ServerConfig.RegistryConfig.RegistryUrl, registry.Options{
+		Cred:     cred,
+		CAFile:   h.ServerConfig.RegistryConfig.RegistryCaFile,
+		Insecure: h.ServerConfig.RegistryConfig.RegistryInsecure,
+
+		CheckUpstream: h.ServerConfig.SyncConfig.CheckUpstreamDigest,
+		UpstreamCred:  h.upstreamCred,
+		UpstreamWait:  h.checks.Wait,
+	})
+}
+
+// Copier of the configured engine, the native engine connects to the mirror for each run
+func (h *Handler) newCopier() (Copier, error) {
+	switch h.ServerConfig.SyncConfig.CopyEngine {
+	case "", ENGINE_SKOPEO:
+		return h.skopeo, nil
+	case ENGINE_NATIVE:
+		return h.newNative()
+	}
+	return nil, fmt.Errorf("unknown copy engine: %s", h.ServerConfig.SyncConfig.CopyEngine)
+}
+
+// Native engine connected to the mirror registry
+func (h *Handler) newNative() (*native.Native, error) {
+	cred, err := h.registryCred()
+	if err != nil {
+		return nil, err
+	}
+	copier, err := native.New(h.ServerConfig.RegistryConfig.RegistryUrl, native.Options{
+		Cred:       cred,
+		CAFile:     h.ServerConfig.RegistryConfig.RegistryCaFile,
+		Insecure:   h.ServerConfig.RegistryConfig.RegistryInsecure,
+		SourceCred: h.upstreamCred,
+	})
+	if err != nil {
+		return nil, err
+	}
+	copier.CopyMode = h.ServerConfig.SyncConfig.CopyMode
+	return copier, nil
+}
+
+// Mirror registry credential, found in the auth file when registryCred is empty
+func (h *Handler) registryCred() (string, error) {
+	cred := h.ServerConfig.RegistryConfig.RegistryCred
+	if cred != "" || h.ServerConfig.CredConfig.AuthFile == "" {
+		return cred, nil
+	}
+	authFile, err := h.loadAuthFile()
+	if err != nil {
+		return "", err
+	}
+	if username, password, ok := authFile.Lookup(registryHost(h.ServerConfig.RegistryConfig.RegistryUrl)); ok {
+		cred = username + ":" + password
+		logger.AddSecret(cred)
+	}
+	return cred, nil
+}
+
+// Credential of the image's source registry, the same skopeo copy pulls with
+func (h *Handler) upstreamCred(image string) string {
+	if cred := h.skopeo.Cred(image); cred != "" {
+		return cred
+	}
+	if h.ServerConfig.CredConfig.AuthFile == "" {
+		return ""
+	}
+	authFile, err := h.loadAuthFile()
+	if err != nil {
+		log.Error.Printf("Cannot read auth file: %v", err)
+		return ""
+	}
+	if username, password, ok := authFile.Lookup(domainOf(image)); ok {
+		cred := username + ":" + password
+		logger.AddSecret(cred)
+		return cred
+	}
+	return ""
+}
+
+// Configured auth file, its credential helpers run through the executor
+func (h *Handler) loadAuthFile() (*skopeo.AuthFile, error) {
+	authFile, err := skopeo.LoadAuthFile(h.ServerConfig.CredConfig.AuthFile)
+	if err != nil {
+		return nil, err
+	}
+	authFile.Executor = h.executor
+	return authFile, nil
+}
+
+// registry url without scheme and trailing slash
+func registryHost(url string) string {
+	if idx := strings.Index(url, "://"); idx >= 0 {
+		url = url[idx+3:]
+	}
+	return strings.TrimSuffix(url, "/")
+}
+
+// Print the sync plan without copying or deleting anything (CLI dry run mode)
+func (s *Server) DryRun(w io.Writer) error {
+	plan, err := s.handler.plan(s.handler.syncOptions(url.Values{}))
+	if err != nil {
+		return err
+	}
+	return writePlan(w, plan)
+}
+
 // [api] total task controller : sync & export
 func (h *Handler) controll(w http.ResponseWriter, req *http.Request) {
 	log.Info.Println("[/] Header: ", req.Header.Get("Content-Type"))
-	h.health(w, req)
-	h.sync(w, req)
-	h.pushv1(w, req)
-	h.export(w, req)
+	opts := h.syncOptions(req.URL.Query())
+	// a dry run only plans the sync, push v1 and export change the mirror and the release sheet
+	if !opts.DryRun {
+		if !h.acquire(w, "controller") {
+			return
+		}
+		defer h.lock.unlock()
+	}
+
+	r := &ControllerReport{}
+	r.Health = h.runHealth()
+	if req.Method == http.MethodGet {
+		r.Sync = h.runSync(opts, nil)
+	}
+	if opts.DryRun {
+		writeReport(w, req, r.status(), r)
+		return
+	}
+	r.PushV1 = h.runPushV1()
+	if req.Method == http.MethodPost {
+		r.Export = h.runExport(nil)
+	}
+	writeReport(w, req, r.status(), r)
 }
 
 // [api] registry health check
 func (h *Handler) health(w http.ResponseWriter, req *http.Request) {
 	log.Info.Println("[/health] Header: ", req.Header.Get("Content-Type"))
-	registryInstance, err := registry.NewRegistry(h.ServerConfig.RegistryConfig.RegistryUrl)
-	if err != nil {
-		fmt.Fprintln(w, err)
-		return
-	}
-	err = registryInstance.GetRegistry()
-	if err != nil {
-		fmt.Fprintln(w, "Registry Server Fail")
-	} else {
-		fmt.Fprintf(w, "Registry Server [%s] 200 OK!\n", h.ServerConfig.RegistryConfig.RegistryUrl)
-	}
+	r := h.runHealth()
+	writeReport(w, req, r.status(), r)
 }
 
 // [api] synchronize image registry & google sheets
+// GET runs the sync in the request, POST starts a background job (GET /jobs/{id}).
+// with "?dryRun=true" only the computed copy/delete plan is returned
 func (h *Handler) sync(w http.ResponseWriter, req *http.Request) {
 	log.Info.Println("[/sync] Header: ", req.Header.Get("Content-Type"))
-	imageList = []string{}
-	exceptImageList = []string{}
-
-	if req != nil && req.Method == "GET" {
-		// if want change the target sheet ranges, find params and update target sheet envs
-		ranges, ok := req.URL.Query()["range"]
-		if ok && len(ranges[0]) >= 1 {
-			log.Info.Println("Target Sheet Range Update to " + string(ranges[0]))
-			h.ServerConfig.GoogleConfig.SheetsRange = string(ranges[0])
+	opts := h.syncOptions(req.URL.Query())
+	switch req.Method {
+	case http.MethodGet:
+		// a dry run changes nothing, it does not need the lock
+		if !opts.DryRun {
+			if !h.acquire(w, "sync") {
+				return
+			}
+			defer h.lock.unlock()
 		}
-		// 1. create instance
-		gsheetInstance, err := gsheet.NewGsheet(h.ServerConfig.GoogleConfig.GoogleCredentials, h.ServerConfig.GoogleConfig.TargetSheets, h.ServerConfig.GoogleConfig.SheetsRange, "")
-		if err != nil {
-			fmt.Fprintln(w, err)
+		r := h.runSync(opts, nil)
+		writeReport(w, req, r.status(), r)
+	case http.MethodPost:
+		if !opts.DryRun && !h.acquire(w, "sync job") {
 			return
 		}
-		registryInstance, err := registry.NewRegistry(h.ServerConfig.RegistryConfig.RegistryUrl)
-		if err != nil {
-			fmt.Fprintln(w, err)
+		h.submit(w, req, "sync", func(job *Job) statusReport {
+			if !opts.DryRun {
+				defer h.lock.unlock()
+			}
+			return h.runSync(opts, job)
+		})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// [api] push v1 based images using docker pull, tag, push
+func (h *Handler) pushv1(w http.ResponseWriter, req *http.Request) {
+	log.Info.Println("[/pushv1] Header: ", req.Header.Get("Content-Type"))
+	if !h.acquire(w, "pushv1") {
+		return
+	}
+	defer h.lock.unlock()
+	r := h.runPushV1()
+	writeReport(w, req, r.status(), r)
+}
+
+// [api] make tar file and export ftp server & write on google sheets what images saved in export files
+// runs as a background job (GET /jobs/{id}), "?wait=true" runs it in the request
+func (h *Handler) export(w http.ResponseWriter, req *http.Request) {
+	log.Info.Println("[/export] Header: ", req.Header.Get("Content-Type"))
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if wait, _ := strconv.ParseBool(req.URL.Query().Get("wait")); wait {
+		if !h.acquire(w, "export") {
 			return
 		}
-		// 2. get all google sheet image list
-		imageList, exceptImageList, err = gsheetInstance.GetGsheet()
+		defer h.lock.unlock()
+		r := h.runExport(nil)
+		writeReport(w, req, r.status(), r)
+		return
+	}
+	if !h.acquire(w, "export job") {
+		return
+	}
+	h.submit(w, req, "export", func(job *Job) statusReport {
+		defer h.lock.unlock()
+		return h.runExport(job)
+	})
+}
+
+// [api] recent sync/export jobs
+func (h *Handler) listJobs(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, h.jobs.List())
+}
+
+// [api] job status, progress and per-image result log
+func (h *Handler) getJob(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/jobs/")
+	job, ok := h.jobs.Get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("job %s not found", id), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, job.Snapshot())
+}
+
+// Source registry of the image, docker hub when the first component is not a host
+func domainOf(image string) string {
+	ref, err := registry.ParseNormalized(image)
+	if err != nil {
+		return ""
+	}
+	return ref.Domain
+}
+
+// Take the run lock or answer 409 when another run is in progress
+func (h *Handler) acquire(w http.ResponseWriter, owner string) bool {
+	if running, ok := h.lock.tryLock(owner); !ok {
+		http.Error(w, fmt.Sprintf("%s is running, try again later", running), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// Per-request sync overrides, never written back to the server config
+func (h *Handler) syncOptions(query url.Values) syncOptions {
+	opts := syncOptions{
+		SheetsRange: h.ServerConfig.GoogleConfig.SheetsRange,
+		Confirm:     query.Get("confirm"),
+	}
+	// if want change the target sheet ranges for this run, find params
+	if ranges, ok := query["range"]; ok && len(ranges[0]) >= 1 {
+		log.Info.Println("Target Sheet Range for this run: " + ranges[0])
+		opts.SheetsRange = ranges[0]
+	}
+	opts.DryRun, _ = strconv.ParseBool(query.Get("dryRun"))
+	return opts
+}
+
+// Start a background job and answer 202 with its id
+func (h *Handler) submit(w http.ResponseWriter, req *http.Request, kind string, run jobFunc) {
+	job := h.jobs.Submit(kind, run)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	if wantsJSON(req) {
+		writeJSON(w, http.StatusAccepted, job.Snapshot())
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Job %s started, GET /jobs/%s\n", job.ID, job.ID)
+}
+
+func (h *Handler) runHealth() *HealthReport {
+	r := &HealthReport{Registry: h.ServerConfig.RegistryConfig.RegistryUrl}
+	registryInstance, err := h.mirror()
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	if err := registryInstance.GetRegistry(); err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.Healthy = true
+	return r
+}
+
+// job is nil when the sync runs inside the request
+func (h *Handler) runSync(opts syncOptions, job *Job) *SyncReport {
+	r := &SyncReport{Copy: []ImageResult{}, Delete: []ImageResult{}}
+
+	// 1~5. read google sheet, find images to copy & delete
+	plan, err := h.plan(opts)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.Plan = plan
+	r.DryRun = opts.DryRun
+	if r.DryRun {
+		r.Summary = map[string]int{}
+		return r
+	}
+
+	// 6. copy images into registry if not exists
+	copier, err := h.newCopier()
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	job.addTotal(len(plan.Copy) + len(plan.Delete))
+	copied := make([]ImageResult, len(plan.Copy))
+	h.pool.Run(len(plan.Copy), func(i int) {
+		copyImage := plan.Copy[i]
+		mode := plan.CopyModes[copyImage]
+		output, attempts, err := h.ServerConfig.SyncConfig.Retry.Do(func() (string, error) {
+			h.pool.Wait(domainOf(copyImage))
+			output, applied, err := copier.Copy(copyImage, skopeo.CopyOptions{Mode: plan.CopyModes[copyImage], Target: plan.Targets[copyImage]})
+			mode = applied
+			return output, err
+		})
+		copied[i] = ImageResult{Image: copyImage, Status: STATUS_COPIED, Attempts: attempts, Mode: mode}
 		if err != nil {
-			fmt.Fprintln(w, err)
-			return
+			copied[i] = ImageResult{Image: copyImage, Status: STATUS_FAILED, Output: output, Attempts: attempts, Mode: mode}
 		}
-		// 3. copy images into registry if not exists
-		copyImageList, failed := registryInstance.FindCopyImageList(imageList)
-		fmt.Fprintln(w, "Copy Image List")
-		skopeos := skopeo.GetInstance(h.ServerConfig.CredConfig.DockerCred, h.ServerConfig.CredConfig.QuayCred, h.ServerConfig.CredConfig.GcrCred,
-			h.ServerConfig.RegistryConfig.RegistryUrl)
-		for idx, copyImage := range copyImageList {
-			fmt.Fprintf(w, "[%d] %s\n", idx+1, copyImage)
-			output, err := skopeos.Copy(copyImage)
-			if err != nil {
-				fmt.Fprintf(w, "[FAIL][%d] %s:%s", idx+1, copyImage, output)
-				failed = append(failed, copyImage)
-			}
-		}
-		if len(failed) > 0 {
-			fmt.Fprintln(w, "List of images that failed to find and copy")
-			for idx, failImage := range failed {
-				fmt.Fprintf(w, "[%d] %s\n", idx+1, failImage)
+		job.record(copied[i])
+	})
+
+	// results in the original sheet order
+	results := map[string]ImageResult{}
+	for _, result := range copied {
+		results[result.Image] = result
+	}
+	for _, failImage := range plan.Failed {
+		results[failImage] = ImageResult{Image: failImage, Status: STATUS_FAILED, Output: "cannot find image in registry"}
+	}
+	// invalid, exported and excluded rows merged back by their position in the sheet
+	for _, row := range plan.Rows {
+		switch {
+		case row.Ignored != "":
+			continue
+		case row.Error != "":
+			r.Copy = append(r.Copy, ImageResult{Image: row.Image, Status: STATUS_FAILED, Output: fmt.Sprintf("%s line %d: %s", row.Range, row.Line, row.Error)})
+		case row.Export:
+			result, ok := results[row.Image]
+			if !ok {
+				result = ImageResult{Image: row.Image, Status: STATUS_PRESENT, Mode: plan.CopyModes[row.Image]}
 			}
+			r.Copy = append(r.Copy, result)
+		default:
+			r.Copy = append(r.Copy, ImageResult{Image: row.Image, Status: STATUS_SKIPPED, Output: "export is false, kept in the registry and left out of the export"})
 		}
-		// 4. Delete images stored in the registry but not in the Google Sheets list
-		fmt.Fprintln(w, "Delete Image List")
-		deleteImageList := registryInstance.FindDeleteImageList(imageList)
-		for idx, deleteImage := range deleteImageList {
-			fmt.Fprintf(w, "[%d] %s\n", idx+1, deleteImage)
-			output, err := skopeos.Delete(deleteImage)
-			if err != nil {
-				fmt.Fprintf(w, "[FAIL][%d] %s:%s", idx+1, deleteImage, output)
-			}
+	}
+
+	// 7. Delete images stored in the registry but not in the Google Sheets list
+	deleted := make([]ImageResult, len(plan.Delete))
+	h.pool.Run(len(plan.Delete), func(i int) {
+		deleteImage := plan.Delete[i]
+		output, attempts, err := h.ServerConfig.SyncConfig.Retry.Do(func() (string, error) {
+			h.pool.Wait(h.ServerConfig.RegistryConfig.RegistryUrl)
+			return copier.Delete(deleteImage)
+		})
+		deleted[i] = ImageResult{Image: deleteImage, Status: STATUS_DELETED, Attempts: attempts}
+		if err != nil {
+			deleted[i] = ImageResult{Image: deleteImage, Status: STATUS_FAILED, Output: output, Attempts: attempts}
 		}
+		job.record(deleted[i])
+	})
+	r.Delete = append(r.Delete, deleted...)
+	for _, image := range plan.Protected {
+		r.Delete = append(r.Delete, ImageResult{Image: image, Status: STATUS_SKIPPED, Output: "protected"})
 	}
-}
+	for _, image := range plan.Blocked {
+		r.Delete = append(r.Delete, ImageResult{Image: image, Status: STATUS_SKIPPED, Output: plan.DeleteBlocked})
+	}
+	r.Summary = summarize(r.Copy, r.Delete)
 
-// [api] push v1 based images using docker pull, tag, push
-func (h *Handler) pushv1(w http.ResponseWriter, req *http.Request) {
-	log.Info.Println("[/pushv1] Header: ", req.Header.Get("Content-Type"))
+	// 8. show the result of every row next to it in the target sheet
+	h.writeRowStatus(opts, plan, r.Copy)
+	return r
+}
 
-	gsheetInstance, err := gsheet.NewGsheet(h.ServerConfig.GoogleConfig.GoogleCredentials, h.ServerConfig.GoogleConfig.TargetSheets, "unsupported!C2:D", "")
+// Write status, time and mirrored digest of every row back to the target sheet (status column configured)
+func (h *Handler) writeRowStatus(opts syncOptions, plan *SyncPlan, results []ImageResult) {
+	if h.ServerConfig.GoogleConfig.SheetColumns.Status == "" {
+		return
+	}
+	gsheetInstance, err := h.targetSheet(opts.SheetsRange)
 	if err != nil {
-		fmt.Fprintln(w, err)
+		log.Error.Printf("Cannot write row status: %v", err)
 		return
 	}
-	imageList, exceptImageList, err = gsheetInstance.GetGsheet()
+	registryInstance, err := h.mirror()
 	if err != nil {
-		fmt.Fprintln(w, err)
+		log.Error.Printf("Cannot write row status: %v", err)
 		return
 	}
+	byImage := map[string]ImageResult{}
+	for _, result := range results {
+		byImage[result.Image] = result
+	}
+	failed := map[string]bool{}
+	for _, image := range plan.Failed {
+		failed[image] = true
+	}
+	mirror := plan.mirrorOptions()
+
+	now := time.Now()
+	statuses := make([]gsheet.RowStatus, len(plan.Rows))
+	for idx, row := range plan.Rows {
+		status := gsheet.RowStatus{Time: now}
+		result := byImage[row.Image]
+		switch {
+		case row.Ignored != "":
+			status.Status = row.Ignored
+		case row.Error != "":
+			status.Status = row.Error
+		case !row.Export:
+			status.Status = ROW_EXCLUDED
+		case failed[row.Image]:
+			status.Status = "check failed: cannot find image in registry"
+		case result.Status == STATUS_FAILED:
+			status.Status = "copy failed: " + skopeo.ErrorReason(result.Output)
+		default:
+			status.Status = ROW_SYNCED
+			if row.Warning != "" {
+				status.Status += ", " + row.Warning
+			}
+			if status.Digest, err = registryInstance.MirrorDigest(row.Image, mirror[row.Image]); err != nil {
+				log.Error.Printf("Cannot get mirrored digest of %s: %v", row.Image, err)
+			}
+		}
+		statuses[idx] = status
+	}
+	if err := gsheetInstance.SetRowStatus(plan.Rows, statuses); err != nil {
+		log.Error.Printf("Cannot write row status: %v", err)
+	}
+}
+
+func (h *Handler) runPushV1() *PushReport {
+	r := &PushReport{Push: []ImageResult{}}
+	gsheetInstance, err := h.sheet(SheetSpec{SpreadsheetId: h.ServerConfig.GoogleConfig.TargetSheets, ReadRange: "unsupported!C2:D"})
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	imageList, _, err := gsheetInstance.GetGsheet()
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	// pushed under the familiar name and tag, the same mirror layout as the native engine
+	push := func(image string) (string, error) {
+		ref, err := registry.ParseNormalized(image)
+		if err == nil && ref.Tag == "" {
+			err = fmt.Errorf("%s is pinned by digest only, docker push needs a tag", image)
+		}
+		if err != nil {
+			return err.Error(), err
+		}
+		return command.DockerCopy(h.executor, image, registryHost(h.ServerConfig.RegistryConfig.RegistryUrl)+"/"+ref.MirrorTag(""))
+	}
+	if h.ServerConfig.SyncConfig.PushV1Engine == ENGINE_NATIVE {
+		copier, err := h.newNative()
+		if err != nil {
+			r.Error = err.Error()
+			return r
+		}
+		push = copier.PushV1
+	}
 	for _, image := range imageList {
-		output, err := command.DockerCopy(h.ServerConfig.RegistryConfig.RegistryUrl, image)
+		output, err := push(image)
 		if err != nil {
-			fmt.Fprintln(w, output)
+			r.Push = append(r.Push, ImageResult{Image: image, Status: STATUS_FAILED, Output: output})
 		} else {
-			fmt.Fprintf(w, "Push Docker V1 image : %s\n", image)
+			r.Push = append(r.Push, ImageResult{Image: image, Status: STATUS_PUSHED})
 		}
 	}
+	r.Summary = summarize(r.Push)
+	return r
 }
 
-// [api] make tar file and export ftp server & write on google sheets what images saved in export files
-func (h *Handler) export(w http.ResponseWriter, req *http.Request) {
-	log.Info.Println("[/export] Header: ", req.Header.Get("Content-Type"))
-	tarName = ""
-
-	if req != nil && req.Method == "POST" {
-		// 1. create tar.gz name
-		now := time.Now()
-		tarName = fmt.Sprintf("%s.tar.gz", now.Format(YYMMDDhhmmss))
-		fmt.Fprintf(w, "Archiving %s ...\n", tarName)
-
-		// 2. tar command run
-		tarCmd := fmt.Sprintf("tar --create --gzip --file=%s -C %s .", tarName, h.ServerConfig.RegistryConfig.ArchivePath)
-		log.Info.Println(tarCmd)
-		tarOutput, tarErr := command.Run(tarCmd)
-		if tarErr != nil {
-			log.Error.Print(tarOutput)
-			fmt.Fprintln(w, tarOutput)
-			return
-		}
-
-		// 3. upload tar file to file repo
-		fmt.Fprintf(w, "Uploading %s to %s ...\n", tarName, h.ServerConfig.RegistryConfig.ScpDest)
-		// sshpass -p{PASSWORD} scp -o StrictHostKeyChecking=no {TAR} {DEST}
-		sshCmd := fmt.Sprintf("sshpass -p%s scp -o StrictHostKeyChecking=no %s %s",
-			h.ServerConfig.RegistryConfig.ScpPass, tarName, h.ServerConfig.RegistryConfig.ScpDest)
-		log.Info.Println(sshCmd)
-		sshOutput, sshErr := command.Run(sshCmd)
-		if sshErr != nil {
-			log.Error.Print(sshOutput)
-			fmt.Fprintln(w, sshOutput)
-		}
+// job is nil when the export runs inside the request
+func (h *Handler) runExport(job *Job) *ExportReport {
+	r := &ExportReport{Steps: []StepResult{}, Images: []string{}}
+	job.addTotal(5)
 
-		// 4. delete tar file
-		fmt.Fprintf(w, "Delete %s ...\n", tarName)
-		delCmd := fmt.Sprintf("rm -rf %s", tarName)
-		log.Info.Println(delCmd)
-		delOutput, delErr := command.Run(delCmd)
-		if delErr != nil {
-			log.Error.Print(delOutput)
-			fmt.Fprintln(w, delOutput)
+	// 0. read the image list from the target sheet, each export owns its list
+	gsheetTarget, err := h.targetSheet(h.ServerConfig.GoogleConfig.SheetsRange)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	rows, _, err := gsheetTarget.GetRows()
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	imageList := []string{}
+	for _, row := range rows {
+		if row.Export && row.Error == "" && row.Ignored == "" {
+			imageList = append(imageList, row.Image)
 		}
+	}
+	r.CopyModes = h.copyModes(rows)
+
+	// 1. create tar.gz name
+	now := time.Now()
+	tarName := fmt.Sprintf("%s.tar.gz", now.Format(YYMMDDhhmmss))
+	r.Archive = tarName
+	r.Format = h.ServerConfig.RegistryConfig.ArchiveFormat
+	if r.Format == "" {
+		r.Format = ARCHIVE_OCI
+	}
 
-		// 5. Create gsheet instance, Add a new sheet and Set write range (target_sheet : {tarName}!B1)
-		gsheetInstance, err := gsheet.NewGsheet(h.ServerConfig.GoogleConfig.GoogleCredentials, h.ServerConfig.GoogleConfig.ReleaseSheets, "", "")
-		if err != nil {
-			fmt.Fprintln(w, err)
-			return
+	// 2. archive the registry storage, or only the exported images
+	var archiveOutput string
+	var archiveErr error
+	switch r.Format {
+	case ARCHIVE_STORAGE:
+		// excluded images stay in the registry but are left out of the archive & the release sheet
+		r.Excluded = excludeMembers(h.ServerConfig.RegistryConfig.ArchivePath, rows)
+		archiveOutput, archiveErr = h.archiveStorage(tarName, r.Excluded)
+	case ARCHIVE_OCI:
+		var stats *native.ArchiveStats
+		stats, archiveErr = h.archiveImages(tarName, rows)
+		if stats != nil {
+			// the release sheet lists what the archive holds
+			imageList = stats.Images
+			r.Skipped = stats.Skipped
+			archiveOutput = fmt.Sprintf("%d images, %d blobs (%d bytes)", len(stats.Images), stats.Blobs, stats.Size)
 		}
-		err = gsheetInstance.AddNewSheet(tarName)
-		if err != nil {
-			fmt.Fprintln(w, err)
-			return
+		if archiveErr != nil {
+			archiveOutput = archiveErr.Error()
 		}
-		fmt.Fprintln(w, "Add a new sheet Success")
+	default:
+		archiveErr = fmt.Errorf("unknown archive format: %s", r.Format)
+		archiveOutput = archiveErr.Error()
+	}
+	r.Images = imageList
+	r.step(job, StepResult{Step: fmt.Sprintf("Archiving %s ...", tarName), Ok: archiveErr == nil, Output: archiveOutput})
+	if archiveErr != nil {
+		log.Error.Print(archiveOutput)
+		r.Error = fmt.Sprintf("cannot archive %s: %v", tarName, archiveErr)
+		os.Remove(tarName)
+		return r
+	}
 
-		// 6. Write image list in new sheet
-		gsheetInstance.WriteRange = fmt.Sprintf("%s!A1:B", tarName)
-		err = gsheetInstance.SetGsheet(imageList)
-		if err != nil {
-			fmt.Fprintln(w, err)
-			return
-		}
-		fmt.Fprintln(w, "Write image list in new sheet Success")
+	// 3. upload tar file to file repo
+	// SSHPASS={PASSWORD} sshpass -e scp -o StrictHostKeyChecking=no {TAR} {DEST}
+	sshCmd := command.New("sshpass", "-e", "scp", "-o", "StrictHostKeyChecking=no", tarName, h.ServerConfig.RegistryConfig.ScpDest)
+	sshCmd.Env = []string{"SSHPASS=" + h.ServerConfig.RegistryConfig.ScpPass}
+	sshCmd.Timeout = EXPORT_TIMEOUT
+	log.Info.Println(sshCmd)
+	sshOutput, sshErr := command.Output(context.Background(), h.executor, sshCmd)
+	r.step(job, StepResult{Step: fmt.Sprintf("Uploading %s to %s ...", tarName, h.ServerConfig.RegistryConfig.ScpDest), Ok: sshErr == nil, Output: sshOutput})
+	if sshErr != nil {
+		// the archive is kept for a manual upload, the release sheet lists uploaded archives only
+		log.Error.Print(sshOutput)
+		r.Error = fmt.Sprintf("cannot upload %s to %s, the archive is kept: %v", tarName, h.ServerConfig.RegistryConfig.ScpDest, sshErr)
+		return r
+	}
+
+	// 4. delete tar file
+	log.Info.Printf("Delete %s", tarName)
+	delErr := os.Remove(tarName)
+	delOutput := ""
+	if delErr != nil {
+		delOutput = delErr.Error()
+		log.Error.Print(delOutput)
+	}
+	r.step(job, StepResult{Step: fmt.Sprintf("Delete %s ...", tarName), Ok: delErr == nil, Output: delOutput})
 
+	// 5. Create gsheet instance with the write range (target_sheet : {tarName}!A1), Add a new sheet
+	writeRange := fmt.Sprintf("%s!A1:C", tarName)
+	gsheetInstance, err := h.sheet(SheetSpec{SpreadsheetId: h.ServerConfig.GoogleConfig.ReleaseSheets, WriteRange: writeRange})
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	err = gsheetInstance.AddNewSheet(tarName)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.step(job, StepResult{Step: "Add a new sheet Success", Ok: true})
+
+	// 6. Write image list in new sheet
+	err = gsheetInstance.SetGsheet(imageList, r.CopyModes)
+	if err != nil {
+		r.Error = err.Error()
+		return r
 	}
+	r.ReleaseSheet = writeRange
+	r.step(job, StepResult{Step: "Write image list in new sheet Success", Ok: true})
+	return r
 }
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gsheet-exporter/internal/command"
+	"github.com/gsheet-exporter/pkg/gsheet"
+	"github.com/gsheet-exporter/pkg/registry"
+)
+
+// Sheet answering scripted rows and recording what is written
+type fakeSheet struct {
+	spec        SheetSpec
+	rows        []gsheet.Row
+	diagnostics []gsheet.Diagnostic
+
+	statuses []gsheet.RowStatus
+	added    []string
+	written  []string
+}
+
+func (sheet *fakeSheet) GetRows() ([]gsheet.Row, []gsheet.Diagnostic, error) {
+	return sheet.rows, sheet.diagnostics, nil
+}
+
+func (sheet *fakeSheet) GetGsheet() ([]string, []string, error) {
+	images, except := []string{}, []string{}
+	for _, row := range sheet.rows {
+		if row.Export {
+			images = append(images, row.Image)
+		} else {
+			except = append(except, row.Image)
+		}
+	}
+	return images, except, nil
+}
+
+func (sheet *fakeSheet) SetRowStatus(rows []gsheet.Row, statuses []gsheet.RowStatus) error {
+	sheet.statuses = statuses
+	return nil
+}
+
+func (sheet *fakeSheet) AddNewSheet(newSheetTitle string) error {
+	sheet.added = append(sheet.added, newSheetTitle)
+	return nil
+}
+
+func (sheet *fakeSheet) SetGsheet(imageList []string, copyModes map[string]string) error {
+	sheet.written = imageList
+	return nil
+}
+
+// Mirror holding the listed images, every other sheet image is copied
+type fakeMirror struct {
+	stored  []string // mirrored "repository:tag"
+	missing []string // sheet images not found upstream
+}
+
+func (mirror *fakeMirror) GetRegistry() error {
+	return nil
+}
+
+func (mirror *fakeMirror) FindCopyImageList(imageList []string, opts map[string]registry.MirrorOptions) ([]string, []string) {
+	copyList, failed := []string{}, []string{}
+	for _, image := range imageList {
+		ref, _ := registry.ParseNormalized(image)
+		switch {
+		case search(mirror.missing, image):
+			failed = append(failed, image)
+		case !search(mirror.stored, ref.MirrorName(opts[image].Target)+":"+ref.Tag):
+			copyList = append(copyList, image)
+		}
+	}
+	return copyList, failed
+}
+
+func (mirror *fakeMirror) FindDeleteImageList(keep []string) ([]string, int) {
+	deleteList := []string{}
+	for _, image := range mirror.stored {
+		if !search(keep, image) {
+			deleteList = append(deleteList, image)
+		}
+	}
+	return deleteList, len(mirror.stored)
+}
+
+func (mirror *fakeMirror) MirrorDigest(image string, opts registry.MirrorOptions) (string, error) {
+	return "sha256:" + strings.Repeat("a", 64), nil
+}
+
+func search(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Server running commands on the fake executor against fake sheets & mirror
+func newTestServer(t *testing.T, config ServerConfig, mirror *fakeMirror, sheets map[string]*fakeSheet) (*Server, *command.Fake) {
+	t.Helper()
+	if config.RegistryConfig.RegistryUrl == "" {
+		config.RegistryConfig.RegistryUrl = "mirror.local:5000"
+	}
+	config.GoogleConfig.TargetSheets = "target"
+	config.GoogleConfig.ReleaseSheets = "release"
+	config.GoogleConfig.SheetsRange = "CK1!C2:D"
+	fake := command.NewFake()
+	srv := New(":0", config).WithExecutor(fake).WithSources(func(spec SheetSpec) (Sheet, error) {
+		sheet, ok := sheets[spec.SpreadsheetId]
+		if !ok {
+			return nil, errors.New("unknown spreadsheet " + spec.SpreadsheetId)
+		}
+		sheet.spec = spec
+		return sheet, nil
+	}, func() (Mirror, error) {
+		return mirror, nil
+	})
+	return srv, fake
+}
+
+func row(image string, export bool) gsheet.Row {
+	return gsheet.Row{Range: "CK1!C2:D", Image: image, Export: export}
+}
+
+func TestSyncCopiesAndDeletes(t *testing.T) {
+	target := &fakeSheet{rows: []gsheet.Row{
+		row("nginx:1.25", true),
+		{Range: "CK1!C2:D", Image: "bad image", Error: "invalid image"},
+		row("quay.io/org/app:1", true),
+		row("redis:7", true),
+		row("kept:1", false),
+	}}
+	mirror := &fakeMirror{stored: []string{"redis:7", "kept:1", "old:1"}}
+	config := ServerConfig{}
+	config.GoogleConfig.SheetColumns = gsheet.Columns{Image: "col:C", Status: "col:E"}
+	// skopeo gets the host, the mirror cred and tls verification
+	config.RegistryConfig.RegistryUrl = "https://mirror.local:5000/"
+	config.RegistryConfig.RegistryCred = "mirror:m1rror-pass"
+	srv, fake := newTestServer(t, config, mirror, map[string]*fakeSheet{"target": target})
+	fake.On("skopeo copy --dest-creds=mirror:m1rror-pass --dest-tls-verify=true docker://quay.io/org/app:1", command.Result{Stderr: "unauthorized: access denied", ExitCode: 1}, nil)
+
+	r := srv.handler.runSync(srv.handler.syncOptions(nil), nil)
+	if r.Error != "" {
+		t.Fatal(r.Error)
+	}
+
+	lines := fake.Lines()
+	want := []string{
+		"skopeo copy --dest-creds=mirror:m1rror-pass --dest-tls-verify=true docker://docker.io/library/nginx:1.25 docker://mirror.local:5000/nginx:1.25",
+		"skopeo copy --dest-creds=mirror:m1rror-pass --dest-tls-verify=true docker://quay.io/org/app:1 docker://mirror.local:5000/quay.io/org/app:1",
+		"skopeo delete --creds=mirror:m1rror-pass --tls-verify=true docker://mirror.local:5000/old:1",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	// copy results in the sheet order, the invalid row included
+	results := []string{}
+	for _, result := range r.Copy {
+		results = append(results, result.Image+" "+result.Status)
+	}
+	wantResults := []string{
+		"nginx:1.25 " + STATUS_COPIED,
+		"bad image " + STATUS_FAILED,
+		"quay.io/org/app:1 " + STATUS_FAILED,
+		"redis:7 " + STATUS_PRESENT,
+		"kept:1 " + STATUS_SKIPPED,
+	}
+	if strings.Join(results, "\n") != strings.Join(wantResults, "\n") {
+		t.Errorf("copy results:\n%s\nwant:\n%s", strings.Join(results, "\n"), strings.Join(wantResults, "\n"))
+	}
+	if len(r.Delete) != 1 || r.Delete[0].Image != "old:1" || r.Delete[0].Status != STATUS_DELETED {
+		t.Errorf("delete results: %+v", r.Delete)
+	}
+	if r.status() != 207 {
+		t.Errorf("status %d, want 207 with a failed copy", r.status())
+	}
+
+	// row statuses written back in the row order
+	got := []string{}
+	for _, status := range target.statuses {
+		got = append(got, status.Status)
+	}
+	wantStatus := []string{ROW_SYNCED, "invalid image", "copy failed: unauthorized", ROW_SYNCED, ROW_EXCLUDED}
+	if strings.Join(got, "|") != strings.Join(wantStatus, "|") {
+		t.Errorf("row statuses %q, want %q", got, wantStatus)
+	}
+}
+
+func TestSyncDryRunRunsNoCommand(t *testing.T) {
+	target := &fakeSheet{rows: []gsheet.Row{row("nginx:1.25", true)}}
+	mirror := &fakeMirror{stored: []string{"old:1"}}
+	srv, fake := newTestServer(t, ServerConfig{}, mirror, map[string]*fakeSheet{"target": target})
+
+	opts := srv.handler.syncOptions(nil)
+	opts.DryRun = true
+	r := srv.handler.runSync(opts, nil)
+	if r.Error != "" {
+		t.Fatal(r.Error)
+	}
+	if len(fake.Calls) != 0 {
+		t.Errorf("dry run ran commands: %v", fake.Lines())
+	}
+	if len(r.Plan.Copy) != 1 || len(r.Plan.Delete) != 1 {
+		t.Errorf("plan copy %v, delete %v", r.Plan.Copy, r.Plan.Delete)
+	}
+}
+
+func TestSyncEmptySheetBlocksDelete(t *testing.T) {
+	target := &fakeSheet{rows: []gsheet.Row{}}
+	mirror := &fakeMirror{stored: []string{"nginx:1.25", "redis:7"}}
+	srv, fake := newTestServer(t, ServerConfig{}, mirror, map[string]*fakeSheet{"target": target})
+
+	r := srv.handler.runSync(srv.handler.syncOptions(nil), nil)
+	if len(fake.Calls) != 0 {
+		t.Errorf("commands run for an empty sheet: %v", fake.Lines())
+	}
+	if r.Plan.DeleteBlocked == "" {
+		t.Error("delete is not blocked for an empty sheet")
+	}
+}
+
+func TestSyncKeepsImagesOfInvalidRows(t *testing.T) {
+	target := &fakeSheet{rows: []gsheet.Row{
+		row("nginx:1.25", true),
+		{Range: "CK1!C2:D", Line: 3, Image: "redis:7", Error: "unknown export value \"maybe\""},
+		{Range: "CK1!C2:D", Line: 4, Image: "app:1", Platform: "linux/amd64,linux/arm64", Error: "cannot copy a subset of platforms"},
+		{Range: "CK1!C2:D", Line: 5, Image: "tool:1", Target: "team/tool", Error: "unknown export value \"maybe\""},
+		// an image listed twice with different targets, both rows are rejected
+		{Range: "CK1!C2:D", Line: 6, Image: "db:1", Target: "team-a/db", Error: "conflicting target or platform in CK1!C2:D line 6, CK1!C2:D line 7"},
+		{Range: "CK1!C2:D", Line: 7, Image: "db:1", Target: "team-b/db", Error: "conflicting target or platform in CK1!C2:D line 6, CK1!C2:D line 7"},
+	}}
+	mirror := &fakeMirror{stored: []string{"nginx:1.25", "redis:7", "app:1", "team/tool:1", "team-a/db:1", "team-b/db:1", "old:1"}}
+	srv, fake := newTestServer(t, ServerConfig{}, mirror, map[string]*fakeSheet{"target": target})
+
+	r := srv.handler.runSync(srv.handler.syncOptions(nil), nil)
+	if r.Error != "" {
+		t.Fatal(r.Error)
+	}
+	want := "skopeo delete --tls-verify=true docker://mirror.local:5000/old:1"
+	if lines := fake.Lines(); len(lines) != 1 || lines[0] != want {
+		t.Errorf("commands %q, want only %q", lines, want)
+	}
+	if len(r.Plan.Invalid) != 5 {
+		t.Errorf("invalid rows %+v", r.Plan.Invalid)
+	}
+}
+
+func TestExportStorage(t *testing.T) {
+	archivePath := t.TempDir()
+	for _, dir := range []string{"nginx/_manifests/tags/1.25", "kept/_manifests/tags/1"} {
+		if err := os.MkdirAll(filepath.Join(archivePath, STORAGE_REPOSITORIES, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target := &fakeSheet{rows: []gsheet.Row{
+		row("nginx:1.25", true),
+		row("kept:1", false),
+	}}
+	release := &fakeSheet{}
+	config := ServerConfig{}
+	config.RegistryConfig.ArchivePath = archivePath
+	config.RegistryConfig.ArchiveFormat = ARCHIVE_STORAGE
+	config.RegistryConfig.ScpDest = "user@files:/data"
+	config.RegistryConfig.ScpPass = "scp-test-pass"
+	srv, fake := newTestServer(t, config, &fakeMirror{}, map[string]*fakeSheet{"target": target, "release": release})
+
+	r := srv.handler.runExport(nil)
+	if r.Error != "" {
+		t.Fatal(r.Error)
+	}
+	lines := fake.Lines()
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "tar --create --gzip --file="+r.Archive) || !strings.HasPrefix(lines[1], "sshpass -e scp") {
+		t.Fatalf("commands: %v", lines)
+	}
+	if !strings.Contains(lines[0], "--exclude="+STORAGE_REPOSITORIES+"/kept/_manifests") {
+		t.Errorf("excluded image is archived: %s", lines[0])
+	}
+	if strings.Contains(lines[0], "/nginx") {
+		t.Errorf("exported image is excluded: %s", lines[0])
+	}
+	if env := fake.Calls[1].Env; len(env) != 1 || env[0] != "SSHPASS=scp-test-pass" {
+		t.Errorf("scp password is not passed in the environment: %v", env)
+	}
+	if strings.Contains(lines[1], "scp-test-pass") {
+		t.Errorf("scp password on the command line: %s", lines[1])
+	}
+	if len(release.added) != 1 || release.spec.WriteRange != release.added[0]+"!A1:C" {
+		t.Errorf("release sheet %v, write range %s", release.added, release.spec.WriteRange)
+	}
+	if strings.Join(release.written, ",") != "nginx:1.25" {
+		t.Errorf("release sheet lists %v", release.written)
+	}
+}
+
+func TestExportStopsWhenArchiveFails(t *testing.T) {
+	target := &fakeSheet{rows: []gsheet.Row{row("nginx:1.25", true)}}
+	release := &fakeSheet{}
+	config := ServerConfig{}
+	config.RegistryConfig.ArchivePath = t.TempDir()
+	config.RegistryConfig.ArchiveFormat = ARCHIVE_STORAGE
+	srv, fake := newTestServer(t, config, &fakeMirror{}, map[string]*fakeSheet{"target": target, "release": release})
+	fake.On("tar", command.Result{Stderr: "tar: No space left on device", ExitCode: 2}, nil)
+
+	r := srv.handler.runExport(nil)
+	if r.Error == "" {
+		t.Fatal("export succeeded with a failed tar")
+	}
+	if lines := fake.Lines(); len(lines) != 1 {
+		t.Errorf("commands after a failed tar: %v", lines)
+	}
+	if len(release.added) != 0 {
+		t.Errorf("release sheet written for a failed export: %v", release.added)
+	}
+}
+
+func TestExportKeepsArchiveWhenUploadFails(t *testing.T) {
+	target := &fakeSheet{rows: []gsheet.Row{row("nginx:1.25", true)}}
+	release := &fakeSheet{}
+	config := ServerConfig{}
+	config.RegistryConfig.ArchivePath = t.TempDir()
+	config.RegistryConfig.ArchiveFormat = ARCHIVE_STORAGE
+	config.RegistryConfig.ScpDest = "user@files:/data"
+	srv, fake := newTestServer(t, config, &fakeMirror{}, map[string]*fakeSheet{"target": target, "release": release})
+	fake.On("sshpass", command.Result{Stderr: "ssh: connect to host files port 22: Connection refused", ExitCode: 1}, nil)
+
+	r := srv.handler.runExport(nil)
+	if r.Error == "" || !strings.Contains(r.Error, r.Archive) {
+		t.Fatalf("export error %q, want the kept archive", r.Error)
+	}
+	for _, step := range r.Steps {
+		if strings.HasPrefix(step.Step, "Delete") {
+			t.Errorf("archive deleted after a failed upload: %+v", step)
+		}
+	}
+	if len(release.added) != 0 || len(release.written) != 0 {
+		t.Errorf("release sheet written for a failed upload: %v %v", release.added, release.written)
+	}
+}
+
+func TestControllerDryRunChangesNothing(t *testing.T) {
+	target := &fakeSheet{rows: []gsheet.Row{row("nginx:1.25", true), row("legacy/app:1", true)}}
+	release := &fakeSheet{}
+	mirror := &fakeMirror{stored: []string{"old:1"}}
+	srv, fake := newTestServer(t, ServerConfig{}, mirror, map[string]*fakeSheet{"target": target, "release": release})
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		rec := httptest.NewRecorder()
+		srv.handler.controll(rec, httptest.NewRequest(method, "/?dryRun=true", nil))
+		if lines := fake.Lines(); len(lines) != 0 {
+			t.Errorf("%s dry run ran %v", method, lines)
+		}
+		if len(release.added) != 0 || len(target.statuses) != 0 {
+			t.Errorf("%s dry run wrote the sheets: %v %v", method, release.added, target.statuses)
+		}
+		if strings.Contains(rec.Body.String(), "Archiving") {
+			t.Errorf("%s dry run exported:\n%s", method, rec.Body.String())
+		}
+	}
+}
+
+func TestPushV1DockerCopy(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("b", 64)
+	unsupported := &fakeSheet{rows: []gsheet.Row{
+		row("legacy/app:1", true),
+		row("quay.io/org/old:2@"+digest, true),
+		row("legacy/pinned@"+digest, true),
+	}}
+	srv, fake := newTestServer(t, ServerConfig{}, &fakeMirror{}, map[string]*fakeSheet{"target": unsupported})
+
+	r := srv.handler.runPushV1()
+	if r.Error != "" {
+		t.Fatal(r.Error)
+	}
+	if unsupported.spec.ReadRange != "unsupported!C2:D" {
+		t.Errorf("read range %s", unsupported.spec.ReadRange)
+	}
+	// pushed under the tag, the digest only pins the pull
+	want := []string{
+		"docker pull legacy/app:1",
+		"docker tag legacy/app:1 mirror.local:5000/legacy/app:1",
+		"docker push mirror.local:5000/legacy/app:1",
+		"docker rmi legacy/app:1 mirror.local:5000/legacy/app:1",
+		"docker pull quay.io/org/old:2@" + digest,
+		"docker tag quay.io/org/old:2@" + digest + " mirror.local:5000/quay.io/org/old:2",
+		"docker push mirror.local:5000/quay.io/org/old:2",
+		"docker rmi quay.io/org/old:2@" + digest + " mirror.local:5000/quay.io/org/old:2",
+	}
+	if got := fake.Lines(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(r.Push) != 3 || r.Push[0].Status != STATUS_PUSHED || r.Push[1].Status != STATUS_PUSHED || r.Push[2].Status != STATUS_FAILED {
+		t.Errorf("push results: %+v", r.Push)
+	}
+}
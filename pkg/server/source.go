@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/gsheet-exporter/pkg/gsheet"
+	"github.com/gsheet-exporter/pkg/registry"
+)
+
+// Spreadsheet range read and written by the handler, *gsheet.Gsheet against the Google Sheets API
+type Sheet interface {
+	GetRows() ([]gsheet.Row, []gsheet.Diagnostic, error)
+	GetGsheet() ([]string, []string, error)
+	SetRowStatus(rows []gsheet.Row, statuses []gsheet.RowStatus) error
+	AddNewSheet(newSheetTitle string) error
+	SetGsheet(imageList []string, copyModes map[string]string) error
+}
+
+// Mirror registry compared with the sheet, *registry.Registry
+type Mirror interface {
+	GetRegistry() error
+	FindCopyImageList(imageList []string, mirror map[string]registry.MirrorOptions) ([]string, []string)
+	FindDeleteImageList(keep []string) ([]string, int)
+	MirrorDigest(image string, opts registry.MirrorOptions) (string, error)
+}
+
+// Range of a spreadsheet opened by the handler
+type SheetSpec struct {
+	SpreadsheetId string
+	ReadRange     string
+	WriteRange    string
+	Columns       gsheet.Columns // target sheet only, positional when empty
+	ExportFlag    gsheet.ExportFlag
+	ConflictRule  string
+}
+
+// Open the sheet and mirror sources, ex) in-memory sources in tests
+type SheetOpener func(spec SheetSpec) (Sheet, error)
+type MirrorOpener func() (Mirror, error)
+
+// Replace the Google Sheets API and the mirror registry client
+func (s *Server) WithSources(sheets SheetOpener, mirror MirrorOpener) *Server {
+	s.handler.openSheet = sheets
+	s.handler.openMirror = mirror
+	return s
+}
+
+func (h *Handler) sheet(spec SheetSpec) (Sheet, error) {
+	if h.openSheet != nil {
+		return h.openSheet(spec)
+	}
+	gsheetInstance, err := gsheet.NewGsheet(h.ServerConfig.GoogleConfig.GoogleCredentials, spec.SpreadsheetId, spec.ReadRange, spec.WriteRange)
+	if err != nil {
+		return nil, err
+	}
+	gsheetInstance.Columns = spec.Columns
+	gsheetInstance.ExportFlag = spec.ExportFlag
+	gsheetInstance.ConflictRule = spec.ConflictRule
+	return gsheetInstance, nil
+}
+
+func (h *Handler) mirror() (Mirror, error) {
+	if h.openMirror != nil {
+		return h.openMirror()
+	}
+	registryInstance, err := h.newRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return registryInstance, nil
+}
@@ -0,0 +1,146 @@
+package skopeo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gsheet-exporter/internal/command"
+	"github.com/gsheet-exporter/pkg/logger"
+)
+
+// Docker-style auth file (~/.docker/config.json, containers auth.json)
+type AuthFile struct {
+	Path        string               `json:"-"`
+	Auths       map[string]AuthEntry `json:"auths,omitempty"`
+	CredHelpers map[string]string    `json:"credHelpers,omitempty"`
+	CredsStore  string               `json:"credsStore,omitempty"`
+
+	Executor command.Executor `json:"-"` // runs the credential helpers
+}
+
+type AuthEntry struct {
+	Auth     string `json:"auth,omitempty"` // base64 "user:pass"
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// docker hub is stored under several keys
+var dockerHubHosts = []string{"docker.io", "index.docker.io", "registry-1.docker.io", "https://index.docker.io/v1/"}
+
+// Expand a leading "~/" to the home directory, skopeo gets the path without a shell
+func ExpandPath(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[2:]), nil
+}
+
+func LoadAuthFile(path string) (*AuthFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	authFile := &AuthFile{}
+	if err := json.Unmarshal(b, authFile); err != nil {
+		return nil, fmt.Errorf("cannot parse auth file %s: %v", path, err)
+	}
+	authFile.Path = path
+	authFile.Executor = command.ExecExecutor{}
+	return authFile, nil
+}
+
+// Credential of the registry host, from the credential helper or the stored auths
+func (authFile *AuthFile) Lookup(host string) (string, string, bool) {
+	hosts := []string{host}
+	for _, hub := range dockerHubHosts {
+		if host == hub {
+			hosts = dockerHubHosts
+			break
+		}
+	}
+
+	for _, h := range hosts {
+		if helper, ok := authFile.CredHelpers[h]; ok {
+			return authFile.credHelper(helper, h)
+		}
+	}
+	for key, entry := range authFile.Auths {
+		if !matchHost(key, hosts) {
+			continue
+		}
+		if entry.Username != "" {
+			return entry.Username, entry.Password, true
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			log.Error.Printf("Invalid auth of %s in %s", key, authFile.Path)
+			continue
+		}
+		cred := strings.SplitN(string(decoded), ":", 2)
+		if len(cred) == 2 {
+			return cred[0], cred[1], true
+		}
+	}
+	if authFile.CredsStore != "" {
+		for _, h := range hosts {
+			if username, password, ok := authFile.credHelper(authFile.CredsStore, h); ok {
+				return username, password, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// Auths keys may carry a scheme or a repository path ("https://harbor.io/", "quay.io/org")
+func matchHost(key string, hosts []string) bool {
+	trimmed := key
+	if idx := strings.Index(trimmed, "://"); idx >= 0 {
+		trimmed = trimmed[idx+3:]
+	}
+	if idx := strings.Index(trimmed, "/"); idx >= 0 {
+		trimmed = trimmed[:idx]
+	}
+	for _, host := range hosts {
+		if key == host || trimmed == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Run "docker-credential-<helper> get" with the host on stdin
+func (authFile *AuthFile) credHelper(helper, host string) (string, string, bool) {
+	cmd := command.New("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+	cmd.Timeout = time.Minute
+	executor := authFile.Executor
+	if executor == nil {
+		executor = command.ExecExecutor{}
+	}
+	result, err := executor.Run(context.Background(), cmd)
+	if err != nil {
+		log.Error.Printf("Credential helper %s has no credential of %s: %v", helper, host, err)
+		return "", "", false
+	}
+	cred := struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}{}
+	if err := json.Unmarshal([]byte(result.Stdout), &cred); err != nil {
+		log.Error.Printf("Cannot parse credential helper %s output: %v", helper, err)
+		return "", "", false
+	}
+	logger.AddSecret(cred.Secret)
+	return cred.Username, cred.Secret, true
+}
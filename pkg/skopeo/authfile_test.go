@@ -0,0 +1,61 @@
+package skopeo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gsheet-exporter/internal/command"
+)
+
+func TestAuthFileCredHelperRunsOnExecutor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{
+		"auths": {"https://harbor.corp.io/": {"auth": "aGFyYm9yOmhhcmJvci1wYXNz"}},
+		"credHelpers": {"quay.io": "secretservice"}
+	}`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authFile, err := LoadAuthFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := command.NewFake().On("docker-credential-secretservice get", command.Result{Stdout: `{"Username":"robot","Secret":"quay-secret"}`}, nil)
+	authFile.Executor = fake
+
+	username, password, ok := authFile.Lookup("quay.io")
+	if !ok || username != "robot" || password != "quay-secret" {
+		t.Errorf("quay.io cred = %s:%s %v", username, password, ok)
+	}
+	if len(fake.Calls) != 1 {
+		t.Fatalf("credential helper calls: %v", fake.Lines())
+	}
+	stdin, _ := ioutil.ReadAll(fake.Calls[0].Stdin)
+	if string(stdin) != "quay.io" {
+		t.Errorf("credential helper stdin = %q", stdin)
+	}
+
+	username, password, ok = authFile.Lookup("harbor.corp.io")
+	if !ok || username != "harbor" || password != "harbor-pass" {
+		t.Errorf("harbor.corp.io cred = %s:%s %v", username, password, ok)
+	}
+	if _, _, ok := authFile.Lookup("ghcr.io"); ok {
+		t.Error("ghcr.io has a cred")
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	path, err := ExpandPath("~/.docker/config.json")
+	if err != nil || path != filepath.Join(home, ".docker/config.json") {
+		t.Errorf("ExpandPath = %s, %v", path, err)
+	}
+	if path, _ := ExpandPath("/etc/auth.json"); path != "/etc/auth.json" {
+		t.Errorf("absolute path changed: %s", path)
+	}
+}
@@ -0,0 +1,72 @@
+package skopeo
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Images copied from a manifest list (multi-arch)
+const (
+	COPY_SYSTEM = "system" // the host platform only, skopeo's default
+	COPY_ALL    = "all"    // every platform, the list is kept as is
+)
+
+const (
+	ALL           = "--all"
+	OVERRIDE_OS   = "--override-os=%s"      // os
+	OVERRIDE_ARCH = "--override-arch=%s"    // arch
+	OVERRIDE_VAR  = "--override-variant=%s" // variant
+)
+
+var platformRegexp = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+// Normalize a copy mode: "system", "all" or a single platform "linux/arm64/v8".
+// Empty is "system". A subset of platforms is rejected: the pushed list would never
+// match the source digest, and copying every platform instead is not what was asked.
+func ParseCopyMode(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "", COPY_SYSTEM:
+		return COPY_SYSTEM, nil
+	case COPY_ALL:
+		return COPY_ALL, nil
+	}
+	if strings.Contains(mode, ",") {
+		return "", fmt.Errorf("cannot copy a subset of platforms %q, use %s or a single os/arch", mode, COPY_ALL)
+	}
+	if !platformRegexp.MatchString(mode) {
+		return "", fmt.Errorf("invalid platform %q, expected os/arch[/variant]", mode)
+	}
+	return mode, nil
+}
+
+// Whether the mode selects one platform ("linux/arm64"), copied as a single image
+func IsPlatform(mode string) bool {
+	return platformRegexp.MatchString(mode)
+}
+
+// The mode actually applied, empty is the host platform
+func AppliedCopyMode(mode string) string {
+	if mode == "" {
+		return COPY_SYSTEM
+	}
+	return mode
+}
+
+// skopeo copy arguments of the mode and the mode actually applied
+func platformArgs(mode string) ([]string, string) {
+	mode = AppliedCopyMode(mode)
+	switch mode {
+	case COPY_SYSTEM:
+		return nil, COPY_SYSTEM
+	case COPY_ALL:
+		return []string{ALL}, COPY_ALL
+	}
+	parts := strings.Split(mode, "/")
+	args := []string{fmt.Sprintf(OVERRIDE_OS, parts[0]), fmt.Sprintf(OVERRIDE_ARCH, parts[1])}
+	if len(parts) > 2 {
+		args = append(args, fmt.Sprintf(OVERRIDE_VAR, parts[2]))
+	}
+	return args, mode
+}
@@ -0,0 +1,24 @@
+package skopeo
+
+import "testing"
+
+func TestParseCopyMode(t *testing.T) {
+	tests := []struct {
+		mode  string
+		want  string
+		valid bool
+	}{
+		{"", COPY_SYSTEM, true},
+		{" All ", COPY_ALL, true},
+		{"linux/arm64", "linux/arm64", true},
+		{"linux/arm/v7", "linux/arm/v7", true},
+		{"linux/amd64,linux/arm64", "", false},
+		{"arm64", "", false},
+	}
+	for _, test := range tests {
+		got, err := ParseCopyMode(test.mode)
+		if (err == nil) != test.valid || got != test.want {
+			t.Errorf("ParseCopyMode(%q) = %q, %v", test.mode, got, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package skopeo
+
+import (
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Retry of failed skopeo commands with exponential backoff
+type RetryPolicy struct {
+	MaxAttempts int           // total attempts, 1 disables retry
+	Backoff     time.Duration // wait before the second attempt, doubled every attempt
+	MaxBackoff  time.Duration
+	Jitter      float64 // random fraction (0~1) added to or removed from each wait
+}
+
+const MAX_REASON_LEN = 100 // characters of a failure reason
+
+// Known failure of a command output and its reason for people
+type failure struct {
+	pattern *regexp.Regexp
+	reason  string
+}
+
+var (
+	// output of failures that never succeed on retry
+	permanentErrors = []failure{
+		{regexp.MustCompile(`\bmanifest unknown\b`), "manifest unknown"},
+		{regexp.MustCompile(`\bname unknown\b`), "repository name unknown"},
+		{regexp.MustCompile(`\bunauthorized\b`), "unauthorized"},
+		{regexp.MustCompile(`\bauthentication required\b`), "authentication required"},
+		{regexp.MustCompile(`\b(access|requested access to the resource is) denied\b`), "access denied"},
+		{regexp.MustCompile(`\binvalid reference format\b`), "invalid reference format"},
+		{regexp.MustCompile(`\brepository name must\b`), "invalid repository name"},
+		{regexp.MustCompile(`\bno such host\b`), "no such host"},
+	}
+	// output of transient failures
+	retryableErrors = []failure{
+		{regexp.MustCompile(`\b429 too many requests\b|\btoomanyrequests\b|\btoo many requests\b`), "too many requests"},
+		{regexp.MustCompile(`\bi/o timeout\b|\btls handshake timeout\b|\btimeout awaiting response headers\b|\bclient\.timeout exceeded\b|\bcontext deadline exceeded\b`), "timeout"},
+		{regexp.MustCompile(`\bconnection reset by peer\b`), "connection reset"},
+		{regexp.MustCompile(`\bconnection refused\b`), "connection refused"},
+		{regexp.MustCompile(`\bunexpected eof\b`), "unexpected eof"},
+		{regexp.MustCompile(`\b500 internal server error\b`), "500 internal server error"},
+		{regexp.MustCompile(`\b502 bad gateway\b`), "502 bad gateway"},
+		{regexp.MustCompile(`\b503 service unavailable\b`), "503 service unavailable"},
+		{regexp.MustCompile(`\b504 gateway timeout\b`), "504 gateway timeout"},
+		{regexp.MustCompile(`\btemporary failure in name resolution\b`), "temporary dns failure"},
+	}
+)
+
+// First known failure of the output, permanent errors first
+func matchFailure(output string) (failure, bool, bool) {
+	lower := strings.ToLower(output)
+	for _, f := range permanentErrors {
+		if f.pattern.MatchString(lower) {
+			return f, false, true
+		}
+	}
+	for _, f := range retryableErrors {
+		if f.pattern.MatchString(lower) {
+			return f, true, true
+		}
+	}
+	return failure{}, false, false
+}
+
+// Whether the command output reports a transient failure.
+// Permanent errors win, unknown failures are not retried.
+func IsRetryable(output string) bool {
+	_, retryable, _ := matchFailure(output)
+	return retryable
+}
+
+// Short reason of a failure for people ("unauthorized", "manifest unknown"),
+// the last output line when no known error matches
+func ErrorReason(output string) string {
+	if f, _, ok := matchFailure(output); ok {
+		return f.reason
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	reason := strings.TrimSpace(lines[len(lines)-1])
+	if len(reason) > MAX_REASON_LEN {
+		reason = reason[:MAX_REASON_LEN] + "..."
+	}
+	return reason
+}
+
+// Run op until it succeeds, fails permanently or runs out of attempts.
+// The last output and the number of attempts are returned.
+func (policy RetryPolicy) Do(op func() (string, error)) (string, int, error) {
+	backoff := policy.Backoff
+	attempt := 1
+	for {
+		output, err := op()
+		if err == nil || attempt >= policy.MaxAttempts || !IsRetryable(output) {
+			return output, attempt, err
+		}
+
+		wait := backoff
+		if policy.Jitter > 0 {
+			wait += time.Duration((rand.Float64()*2 - 1) * policy.Jitter * float64(backoff))
+		}
+		log.Warn.Printf("Attempt %d failed, retry after %s: %s", attempt, wait, strings.TrimSpace(output))
+		time.Sleep(wait)
+
+		attempt++
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
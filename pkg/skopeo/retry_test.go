@@ -0,0 +1,84 @@
+package skopeo
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		output    string
+		retryable bool
+		reason    string
+	}{
+		{"reading manifest 1.25 in docker.io/library/nginx: toomanyrequests: You have reached your pull rate limit", true, "too many requests"},
+		{"received unexpected HTTP status: 429 Too Many Requests", true, "too many requests"},
+		{"dial tcp 10.0.0.1:443: i/o timeout", true, "timeout"},
+		{"net/http: TLS handshake timeout", true, "timeout"},
+		{"read tcp 10.0.0.2:51234->10.0.0.1:443: read: connection reset by peer", true, "connection reset"},
+		{"dial tcp 10.0.0.1:5000: connect: connection refused", true, "connection refused"},
+		{"writing blob: unexpected EOF", true, "unexpected eof"},
+		{"received unexpected HTTP status: 503 Service Unavailable", true, "503 service unavailable"},
+		{"dial tcp: lookup quay.io: Temporary failure in name resolution", true, "temporary dns failure"},
+
+		// permanent errors win over transient ones
+		{"reading manifest 9.9 in docker.io/library/nginx: manifest unknown: manifest unknown", false, "manifest unknown"},
+		{"unauthorized: access denied", false, "unauthorized"},
+		{"requested access to the resource is denied", false, "access denied"},
+		{"toomanyrequests: unauthorized", false, "unauthorized"},
+		{"dial tcp: lookup mirror.local: no such host", false, "no such host"},
+
+		// numbers and words inside digests, paths and other words do not match
+		{"copying blob sha256:4291ac0e: invalid checksum", false, "copying blob sha256:4291ac0e: invalid checksum"},
+		{"reading /etc/timeouts.conf: permission error", false, "reading /etc/timeouts.conf: permission error"},
+		{"repository docker.io/org/deniedlist not found", false, "repository docker.io/org/deniedlist not found"},
+		{"first line\nlast line", false, "last line"},
+		{"", false, ""},
+	}
+	for _, test := range tests {
+		if got := IsRetryable(test.output); got != test.retryable {
+			t.Errorf("IsRetryable(%q) = %v, want %v", test.output, got, test.retryable)
+		}
+		if got := ErrorReason(test.output); got != test.reason {
+			t.Errorf("ErrorReason(%q) = %q, want %q", test.output, got, test.reason)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	failed := errors.New("exit status 1")
+	tests := []struct {
+		name        string
+		maxAttempts int
+		outputs     []string // output of each attempt, the last one succeeds when it is ""
+		attempts    int
+		ok          bool
+	}{
+		{"success", 3, []string{""}, 1, true},
+		{"transient then success", 3, []string{"429 Too Many Requests", "i/o timeout", ""}, 3, true},
+		{"out of attempts", 2, []string{"i/o timeout", "i/o timeout", ""}, 2, false},
+		{"permanent", 3, []string{"manifest unknown", ""}, 1, false},
+		{"unknown failure", 3, []string{"something broke", ""}, 1, false},
+		{"retry disabled", 1, []string{"i/o timeout", ""}, 1, false},
+		{"zero attempts", 0, []string{"i/o timeout", ""}, 1, false},
+	}
+	for _, test := range tests {
+		policy := RetryPolicy{MaxAttempts: test.maxAttempts, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, Jitter: 0.5}
+		calls := 0
+		output, attempts, err := policy.Do(func() (string, error) {
+			output := test.outputs[calls]
+			calls++
+			if output == "" {
+				return "", nil
+			}
+			return output, failed
+		})
+		if attempts != test.attempts || calls != test.attempts || (err == nil) != test.ok {
+			t.Errorf("%s: %d attempts (%d calls), err %v, want %d attempts, ok %v", test.name, attempts, calls, err, test.attempts, test.ok)
+		}
+		if !test.ok && output != test.outputs[attempts-1] {
+			t.Errorf("%s: output %q, want the last attempt's", test.name, output)
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package skopeo
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gsheet-exporter/internal/command"
 	"github.com/gsheet-exporter/pkg/logger"
+	"github.com/gsheet-exporter/pkg/registry"
 )
 
 type Skopeo struct {
@@ -15,14 +21,60 @@ type Skopeo struct {
 	GCrGred    string
 
 	CopyTo string
+
+	// mirror registry connection, the cred wins over the auth file
+	DestCred      string // "user:pass"
+	DestTLSVerify bool
+	DestCAFile    string // extra CA of the mirror, handed to skopeo as a cert dir
+	certDir       string
+	mu            sync.Mutex
+
+	// docker config.json / auth.json used for registries without a cred (source & destination)
+	AuthFile string
+
+	Timeout  time.Duration
+	Executor command.Executor
+
+	// manifest list handling when the image has no mode of its own ("system", "all", "linux/arm64")
+	CopyMode string
+
+	// user-defined profiles matched before the built-in ones
+	ExtraProfiles []Profile
+	profiles      []Profile
+}
+
+// Options of one image copy
+type CopyOptions struct {
+	Mode   string // platforms of a manifest list, empty uses the global CopyMode
+	Target string // mirror repository, empty uses the familiar name
+}
+
+// Source registry of an image matched by pattern, with the credential used to pull from it
+type Profile struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Cred    string
+	Host    bool // Pattern matches the registry host (docker.io), otherwise the normalized image (docker.io/library/nginx:latest)
 }
 
 const (
-	CHECK      = "skopeo inspect docker://%s"                                                    // image
-	CRED_CHECK = "skopeo inspect --creds=%s docker://%s"                                         // cred , image
-	COPY       = "skopeo copy --dest-tls-verify=false docker://%s docker://%s/%s"                // src_image, dest, dest_image
-	CRED_COPY  = "skopeo copy --src-creds=%s --dest-tls-verify=false docker://%s docker://%s/%s" // src_cred, src_image, dest, dest_image
-	DELETE     = "skopeo delete --tls-verify=false docker://%s/%s"                               // url/image
+	SKOPEO    = "skopeo"
+	TRANSPORT = "docker://%s"    // image
+	MIRROR    = "docker://%s/%s" // dest, dest_image
+
+	CREDS         = "--creds=%s"         // cred
+	SRC_CREDS     = "--src-creds=%s"     // src_cred
+	DEST_CREDS    = "--dest-creds=%s"    // mirror cred
+	AUTHFILE      = "--authfile=%s"      // auth file path
+	SRC_AUTHFILE  = "--src-authfile=%s"  // auth file path
+	DEST_AUTHFILE = "--dest-authfile=%s" // auth file path
+
+	TLS_VERIFY      = "--tls-verify=%t"      // verify the mirror certificate
+	DEST_TLS_VERIFY = "--dest-tls-verify=%t" // verify the mirror certificate
+	CERT_DIR        = "--cert-dir=%s"        // dir of the mirror CA
+	DEST_CERT_DIR   = "--dest-cert-dir=%s"   // dir of the mirror CA
+
+	DEFAULT_TIMEOUT = 30 * time.Minute // one skopeo command
 )
 
 var (
@@ -32,9 +84,11 @@ var (
 	log = logger.GetInstance()
 )
 
-func GetInstance(dockerCred, quayCred, gcrCred, copyTo string) *Skopeo {
+func GetInstance(dockerCred, quayCred, gcrCred, copyTo, authFile string, extraProfiles ...Profile) *Skopeo {
 	once.Do(func() {
 		skopeo = New(dockerCred, quayCred, gcrCred, copyTo)
+		skopeo.AuthFile = authFile
+		skopeo.ExtraProfiles = extraProfiles
 	})
 	SetProfiles(skopeo)
 
@@ -47,35 +101,95 @@ func New(dockerCred, quayCred, gcrCred, copyTo string) *Skopeo {
 		QuayCred:   quayCred,
 		GCrGred:    gcrCred,
 		CopyTo:     copyTo,
+		Timeout:    DEFAULT_TIMEOUT,
+		Executor:   command.ExecExecutor{},
 	}
 }
 
 // set creds about image repository & regax repo string
+// built-in profiles match the exact registry host or its subdomains (registry-1.docker.io, us.gcr.io)
 func SetProfiles(skopeo *Skopeo) {
-	/* py3 - 필요한 이유 조사가 필요함
-	    def __init__(self, docker_cred, quay_cred, gcr_cred, copy_to):
-			self.profiles = {
-				'docker.io': {'pattern': re.compile('^[a-z0-9.]*docker.io/'), 'cred': docker_cred},
-				'docker.elastic.co': {'pattern': re.compile('^docker.elastic.co/'), 'cred': ''},
-				'public.ecr.aws': {'pattern': re.compile('^public.ecr.aws/'), 'cred': ''},
-				'ghcr.io': {'pattern': re.compile('^[a-z0-9.]*ghcr.io/'), 'cred': ''},
-				'quay.io': {'pattern': re.compile('^[a-z0-9.]*quay.io/'), 'cred': quay_cred},
-				'gcr': {'pattern': re.compile('^[a-z0-9.]*gcr.io/'), 'cred': gcr_cred}
-			}
-			self.copy_to = copy_to
-	*/
+	profiles := append([]Profile{}, skopeo.ExtraProfiles...)
+	profiles = append(profiles,
+		Profile{Name: "docker.io", Pattern: regexp.MustCompile(`^(?:[a-z0-9-]+\.)*docker\.io$`), Cred: skopeo.DockerCred, Host: true},
+		Profile{Name: "docker.elastic.co", Pattern: regexp.MustCompile(`^docker\.elastic\.co$`), Host: true},
+		Profile{Name: "public.ecr.aws", Pattern: regexp.MustCompile(`^public\.ecr\.aws$`), Host: true},
+		Profile{Name: "ghcr.io", Pattern: regexp.MustCompile(`^(?:[a-z0-9-]+\.)*ghcr\.io$`), Host: true},
+		Profile{Name: "quay.io", Pattern: regexp.MustCompile(`^(?:[a-z0-9-]+\.)*quay\.io$`), Cred: skopeo.QuayCred, Host: true},
+		Profile{Name: "gcr", Pattern: regexp.MustCompile(`^(?:[a-z0-9-]+\.)*gcr\.io$`), Cred: skopeo.GCrGred, Host: true},
+		Profile{Name: "localhost", Pattern: regexp.MustCompile(`^localhost(?::[0-9]+)?$`), Host: true},
+	)
+	skopeo.profiles = profiles
+}
+
+// Find the profile of the image's source registry, an image without a registry host is docker hub.
+// An invalid image matches no profile, so no credential is sent for it.
+func (skopeo *Skopeo) Profile(image string) (Profile, bool) {
+	ref, err := registry.ParseNormalized(image)
+	if err != nil {
+		return Profile{}, false
+	}
+	host := strings.ToLower(ref.Domain)
+	for _, profile := range skopeo.profiles {
+		if profile.Host && profile.Pattern.MatchString(host) {
+			return profile, true
+		}
+		if !profile.Host && profile.Pattern.MatchString(ref.String()) {
+			return profile, true
+		}
+	}
+	return Profile{}, false
+}
 
+// Credential for the image's source registry, empty for anonymous pulls
+func (skopeo *Skopeo) Cred(image string) string {
+	profile, ok := skopeo.Profile(image)
+	if !ok {
+		return ""
+	}
+	return profile.Cred
+}
+
+// Parse user-defined profiles "harbor.corp.io=user:pass,^mirror\.corp/=user:pass".
+// A key starting with "^" is a pattern of the normalized image, otherwise the exact registry host.
+func ParseProfiles(spec string) ([]Profile, error) {
+	profiles := []Profile{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid profile: %s", item)
+		}
+		pattern, host := strings.TrimSpace(kv[0]), false
+		if !strings.HasPrefix(pattern, "^") {
+			pattern, host = "^"+regexp.QuoteMeta(strings.ToLower(pattern))+"$", true
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile pattern %s: %v", kv[0], err)
+		}
+		profiles = append(profiles, Profile{Name: strings.TrimSpace(kv[0]), Pattern: re, Cred: kv[1], Host: host})
+	}
+	return profiles, nil
 }
 
 func (skopeo *Skopeo) Inspect(image string) error {
-	var cmd string
-	if skopeo.DockerCred == "" {
-		cmd = fmt.Sprintf(CHECK, image)
-	} else {
-		cmd = fmt.Sprintf(CRED_CHECK, skopeo.DockerCred, image)
+	// a profile cred wins over the auth file
+	args := []string{"inspect"}
+	if cred := skopeo.Cred(image); cred != "" {
+		args = append(args, fmt.Sprintf(CREDS, cred))
+	} else if skopeo.AuthFile != "" {
+		args = append(args, fmt.Sprintf(AUTHFILE, skopeo.AuthFile))
 	}
-	log.Info.Println(cmd)
-	output, err := command.Run(cmd)
+	if ref, err := registry.ParseNormalized(image); err == nil {
+		image = ref.String()
+	}
+	args = append(args, fmt.Sprintf(TRANSPORT, image))
+
+	output, err := skopeo.run(args)
 	if err != nil {
 		log.Error.Print(output)
 		return err
@@ -83,26 +197,59 @@ func (skopeo *Skopeo) Inspect(image string) error {
 	return nil
 }
 
-func (skopeo *Skopeo) Copy(image string) (string, error) {
-	var cmd string
-	if skopeo.DockerCred == "" {
-		cmd = fmt.Sprintf(COPY, image, skopeo.CopyTo, image)
-	} else {
-		cmd = fmt.Sprintf(CRED_COPY, skopeo.DockerCred, image, skopeo.CopyTo, image)
+// Copy the image into the mirror, the copy mode actually applied is returned
+func (skopeo *Skopeo) Copy(image string, opts CopyOptions) (string, string, error) {
+	mode := opts.Mode
+	if mode == "" {
+		mode = skopeo.CopyMode
 	}
-	log.Info.Println(cmd)
-	output, err := command.Run(cmd)
+	platforms, mode := platformArgs(mode)
+
+	// a profile cred wins over the auth file
+	args := []string{"copy"}
+	if cred := skopeo.Cred(image); cred != "" {
+		args = append(args, fmt.Sprintf(SRC_CREDS, cred))
+	} else if skopeo.AuthFile != "" {
+		args = append(args, fmt.Sprintf(SRC_AUTHFILE, skopeo.AuthFile))
+	}
+	mirrorArgs, err := skopeo.mirrorArgs(DEST_CREDS, DEST_AUTHFILE, DEST_TLS_VERIFY, DEST_CERT_DIR)
+	if err != nil {
+		return err.Error(), mode, err
+	}
+	args = append(args, mirrorArgs...)
+	// pull the fully qualified name, push to the familiar path (docker.io/library/nginx -> {mirror}/nginx) or the target
+	src, dest := image, image
+	if ref, err := registry.ParseNormalized(image); err == nil {
+		src = ref.String()
+		mirror := registry.Reference{Path: ref.MirrorName(opts.Target), Tag: ref.Tag, Digest: ref.Digest}
+		// pull the pinned digest and push it under the tag, a registry does not accept both together
+		if ref.Tag != "" && ref.Digest != "" {
+			src = ref.Name() + "@" + ref.Digest
+			mirror.Digest = ""
+		}
+		dest = mirror.String()
+	}
+	args = append(args, platforms...)
+	args = append(args, fmt.Sprintf(TRANSPORT, src), fmt.Sprintf(MIRROR, skopeo.CopyTo, dest))
+
+	output, err := skopeo.run(args)
 	if err != nil {
 		log.Error.Print(output)
-		return output, err
+		return output, mode, err
 	}
-	return output, nil
+	return output, mode, nil
 }
 
 func (skopeo *Skopeo) Delete(image string) (string, error) {
-	cmd := fmt.Sprintf(DELETE, skopeo.CopyTo, image)
-	log.Info.Println(cmd)
-	output, err := command.Run(cmd)
+	args := []string{"delete"}
+	mirror, err := skopeo.mirrorArgs(CREDS, AUTHFILE, TLS_VERIFY, CERT_DIR)
+	if err != nil {
+		return err.Error(), err
+	}
+	args = append(args, mirror...)
+	args = append(args, fmt.Sprintf(MIRROR, skopeo.CopyTo, image))
+
+	output, err := skopeo.run(args)
 	if err != nil {
 		if strings.Contains(output, "Image may not exist or is not stored with a v2 Schema in a v2 registry") == true {
 			log.Info.Printf("[%s] Not Exists in Registry", image)
@@ -114,3 +261,52 @@ func (skopeo *Skopeo) Delete(image string) (string, error) {
 	}
 	return output, nil
 }
+
+// Credential and tls arguments of the mirror registry, given the flag formats of the command
+func (skopeo *Skopeo) mirrorArgs(creds, authFile, tlsVerify, certDir string) ([]string, error) {
+	args := []string{}
+	if skopeo.DestCred != "" {
+		args = append(args, fmt.Sprintf(creds, skopeo.DestCred))
+	} else if skopeo.AuthFile != "" {
+		args = append(args, fmt.Sprintf(authFile, skopeo.AuthFile))
+	}
+	args = append(args, fmt.Sprintf(tlsVerify, skopeo.DestTLSVerify))
+	if skopeo.DestCAFile != "" {
+		dir, err := skopeo.caDir()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, fmt.Sprintf(certDir, dir))
+	}
+	return args, nil
+}
+
+// skopeo reads CAs from a directory of *.crt files, the CA file is copied into one once
+func (skopeo *Skopeo) caDir() (string, error) {
+	skopeo.mu.Lock()
+	defer skopeo.mu.Unlock()
+	if skopeo.certDir != "" {
+		return skopeo.certDir, nil
+	}
+	pem, err := ioutil.ReadFile(skopeo.DestCAFile)
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir("", "mirror-certs")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), pem, 0644); err != nil {
+		return "", err
+	}
+	skopeo.certDir = dir
+	return dir, nil
+}
+
+// Run skopeo without a shell, image names are single arguments
+func (skopeo *Skopeo) run(args []string) (string, error) {
+	cmd := command.New(SKOPEO, args...)
+	cmd.Timeout = skopeo.Timeout
+	log.Info.Println(cmd)
+	return command.Output(context.Background(), skopeo.Executor, cmd)
+}
@@ -0,0 +1,109 @@
+package skopeo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gsheet-exporter/internal/command"
+)
+
+func TestMirrorArgs(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "corp-ca.pem")
+	if err := ioutil.WriteFile(caFile, []byte("-----BEGIN CERTIFICATE-----\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fake := command.NewFake()
+	skopeo := New("", "", "", "harbor.corp.io")
+	skopeo.Executor = fake
+	skopeo.AuthFile = "/etc/auth.json"
+	skopeo.DestCAFile = caFile
+	SetProfiles(skopeo)
+
+	// auth file for the mirror without a cred, no tls verification for an insecure mirror
+	if _, _, err := skopeo.Copy("nginx:1.25", CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	skopeo.DestCred = "robot:r0bot-pass"
+	skopeo.DestTLSVerify = true
+	if _, err := skopeo.Delete("nginx:1.25"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := fake.Lines()
+	certDir := skopeo.certDir
+	defer os.RemoveAll(certDir)
+	want := []string{
+		"skopeo copy --src-authfile=/etc/auth.json --dest-authfile=/etc/auth.json --dest-tls-verify=false --dest-cert-dir=" + certDir +
+			" docker://docker.io/library/nginx:1.25 docker://harbor.corp.io/nginx:1.25",
+		"skopeo delete --creds=robot:r0bot-pass --tls-verify=true --cert-dir=" + certDir + " docker://harbor.corp.io/nginx:1.25",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+	if pem, err := ioutil.ReadFile(filepath.Join(certDir, "ca.crt")); err != nil || !strings.HasPrefix(string(pem), "-----BEGIN") {
+		t.Errorf("cert dir has no ca.crt: %v", err)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	extra, err := ParseProfiles(`harbor.corp.io=robot:harbor-pass, ^docker\.io/team/=team:team-pass,Mirror.Corp.io:5000=mirror:mirror-pass`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skopeo := New("hub:hub-pass", "quay:quay-pass", "gcr:gcr-pass", "mirror.local:5000")
+	skopeo.ExtraProfiles = extra
+	SetProfiles(skopeo)
+
+	tests := []struct {
+		image   string
+		profile string // "" when no profile matches
+		cred    string
+	}{
+		{"nginx:1.25", "docker.io", "hub:hub-pass"},
+		{"docker.io/library/nginx", "docker.io", "hub:hub-pass"},
+		{"registry-1.docker.io/org/app:1", "docker.io", "hub:hub-pass"},
+		{"quay.io/org/app:1", "quay.io", "quay:quay-pass"},
+		{"us.gcr.io/project/app:1", "gcr", "gcr:gcr-pass"},
+		{"ghcr.io/org/app:1", "ghcr.io", ""},
+		{"localhost:5000/app", "localhost", ""},
+		// user profiles come first: an image pattern wins over the docker.io host
+		{"team/app:1", `^docker\.io/team/`, "team:team-pass"},
+		{"harbor.corp.io/project/app:1", "harbor.corp.io", "robot:harbor-pass"},
+		{"mirror.corp.io:5000/app:1", "Mirror.Corp.io:5000", "mirror:mirror-pass"},
+		// hosts match exactly or as a subdomain, not as a substring
+		{"harbor.corp.io.evil.com/app:1", "", ""},
+		{"notquay.io/org/app:1", "", ""},
+		{"quay.io.evil.com/org/app:1", "", ""},
+		{"docker.io.evil.com/app:1", "", ""},
+		// an invalid image gets no credential
+		{"bad image", "", ""},
+	}
+	for _, test := range tests {
+		profile, ok := skopeo.Profile(test.image)
+		if ok != (test.profile != "") || profile.Name != test.profile {
+			t.Errorf("Profile(%q) = %q %v, want %q", test.image, profile.Name, ok, test.profile)
+		}
+		if cred := skopeo.Cred(test.image); cred != test.cred {
+			t.Errorf("Cred(%q) = %q, want %q", test.image, cred, test.cred)
+		}
+	}
+}
+
+func TestParseProfilesInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"harbor.corp.io",
+		"=robot:pass",
+		`^docker\.io/(team=team:pass`,
+		"harbor.corp.io=robot:pass,quay.io",
+	} {
+		if profiles, err := ParseProfiles(spec); err == nil {
+			t.Errorf("ParseProfiles(%q) = %v, want an error", spec, profiles)
+		}
+	}
+	if profiles, err := ParseProfiles(" , "); err != nil || len(profiles) != 0 {
+		t.Errorf("ParseProfiles of an empty list = %v, %v", profiles, err)
+	}
+}
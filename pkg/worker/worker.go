@@ -0,0 +1,125 @@
+package worker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Allowed requests per period (ex. 100 per 6h for docker hub anonymous pulls)
+type Rate struct {
+	N   int
+	Per time.Duration
+}
+
+// Spread requests evenly over the rate period
+type Limiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// Bounded worker pool with a rate limiter per key (source registry).
+// The limiters live as long as the pool, keep one pool for rates spanning several runs.
+type Pool struct {
+	Concurrency int
+
+	limiters map[string]*Limiter
+}
+
+func NewLimiter(rate Rate) *Limiter {
+	return &Limiter{
+		interval: rate.Per / time.Duration(rate.N),
+	}
+}
+
+// Block until the next request slot
+func (l *Limiter) Wait() {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func NewPool(concurrency int, rates map[string]Rate) *Pool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	limiters := map[string]*Limiter{}
+	for key, rate := range rates {
+		limiters[key] = NewLimiter(rate)
+	}
+	return &Pool{
+		Concurrency: concurrency,
+		limiters:    limiters,
+	}
+}
+
+// Block until the rate limiter of key allows a request, keys without a rate pass at once.
+// Call it before every request, retries included.
+func (p *Pool) Wait(key string) {
+	if limiter, ok := p.limiters[key]; ok {
+		limiter.Wait()
+	}
+}
+
+// Run fn for 0..n-1 on the pool and wait for all of them.
+// fn writes its result at index i so the caller keeps the original order.
+func (p *Pool) Run(n int, fn func(i int)) {
+	tasks := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < p.Concurrency && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		tasks <- i
+	}
+	close(tasks)
+	wg.Wait()
+}
+
+// Parse "docker.io=100/6h,quay.io=30" (no period means per minute)
+func ParseRates(spec string) (map[string]Rate, error) {
+	rates := map[string]Rate{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid rate limit: %s", item)
+		}
+		value := strings.SplitN(strings.TrimSpace(kv[1]), "/", 2)
+		n, err := strconv.Atoi(strings.TrimSpace(value[0]))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid rate limit count: %s", item)
+		}
+		per := time.Minute
+		if len(value) == 2 {
+			per, err = time.ParseDuration(strings.TrimSpace(value[1]))
+			if err != nil || per <= 0 {
+				return nil, fmt.Errorf("invalid rate limit period: %s", item)
+			}
+		}
+		rates[strings.TrimSpace(kv[0])] = Rate{N: n, Per: per}
+	}
+	return rates, nil
+}
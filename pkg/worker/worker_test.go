@@ -0,0 +1,118 @@
+package worker
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRates(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]Rate
+	}{
+		{"", map[string]Rate{}},
+		{"docker.io=100/6h", map[string]Rate{"docker.io": {N: 100, Per: 6 * time.Hour}}},
+		{" docker.io = 100/6h , quay.io=30,, ", map[string]Rate{"docker.io": {N: 100, Per: 6 * time.Hour}, "quay.io": {N: 30, Per: time.Minute}}},
+		{"ghcr.io=5/1m30s", map[string]Rate{"ghcr.io": {N: 5, Per: 90 * time.Second}}},
+	}
+	for _, test := range tests {
+		got, err := ParseRates(test.spec)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseRates(%q) = %v, %v, want %v", test.spec, got, err, test.want)
+		}
+	}
+}
+
+func TestParseRatesInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"docker.io",
+		"docker.io=",
+		"docker.io=abc",
+		"docker.io=0",
+		"docker.io=-5",
+		"docker.io=100/",
+		"docker.io=100/6 hours",
+		"docker.io=100/0s",
+		"docker.io=100/-1h",
+		"quay.io=30,docker.io",
+		"=100/6h",
+	} {
+		if rates, err := ParseRates(spec); err == nil {
+			t.Errorf("ParseRates(%q) = %v, want an error", spec, rates)
+		}
+	}
+}
+
+func TestPoolRunsEveryTaskWithinConcurrency(t *testing.T) {
+	pool := NewPool(3, nil)
+	results := make([]int, 20)
+	var running, peak int32
+	pool.Run(len(results), func(i int) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&peak)
+			if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		results[i] = i * i
+		atomic.AddInt32(&running, -1)
+	})
+	for i, result := range results {
+		if result != i*i {
+			t.Errorf("result %d = %d, want %d", i, result, i*i)
+		}
+	}
+	if peak > 3 {
+		t.Errorf("%d tasks ran at once, concurrency is 3", peak)
+	}
+}
+
+func TestPoolConcurrencyAtLeastOne(t *testing.T) {
+	for _, concurrency := range []int{0, -2} {
+		pool := NewPool(concurrency, nil)
+		if pool.Concurrency != 1 {
+			t.Errorf("NewPool(%d) concurrency %d, want 1", concurrency, pool.Concurrency)
+		}
+		done := 0
+		pool.Run(3, func(i int) { done++ })
+		if done != 3 {
+			t.Errorf("NewPool(%d) ran %d of 3 tasks", concurrency, done)
+		}
+	}
+	// no task, no worker
+	NewPool(2, nil).Run(0, func(i int) { t.Error("task run on an empty pool") })
+}
+
+func TestPoolWaitSpacesRequestsPerKey(t *testing.T) {
+	// 10 requests per 200ms: one slot every 20ms
+	pool := NewPool(4, map[string]Rate{"docker.io": {N: 10, Per: 200 * time.Millisecond}})
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.Wait("docker.io")
+		}()
+	}
+	wg.Wait()
+	// the first slot is free, the next three wait 20, 40 and 60ms
+	if elapsed := time.Since(start); elapsed < 55*time.Millisecond {
+		t.Errorf("4 requests in %s, want at least 60ms", elapsed)
+	}
+
+	// keys without a rate are not limited
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		pool.Wait("quay.io")
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("unlimited key waited %s", elapsed)
+	}
+}